@@ -0,0 +1,305 @@
+package quicktar
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var errUnsupported = errors.New("unsupported file")
+
+// SymlinkPolicy tells AddDir and AddFS how to handle symbolic links.
+type SymlinkPolicy int
+
+const (
+	SymlinkStore  SymlinkPolicy = iota // store the link itself
+	SymlinkFollow                      // store the regular file it points to
+	SymlinkSkip                        // ignore the link
+)
+
+// AddOptions configures AddDir and AddFS. The zero value adds everything
+// and stops on the first error.
+type AddOptions struct {
+	// Filter reports whether to add a file, with its name in the archive.
+	// Returning false on a directory skips the whole directory.
+	Filter func(name string, fi fs.FileInfo) bool
+
+	// Progress is called right before a file is added.
+	Progress func(name string, fi fs.FileInfo)
+
+	// DataProgress is called with the number of bytes of file data just
+	// added, at least once per 1 MiB.
+	DataProgress func(n int64)
+
+	// Symlink sets how symbolic links are handled. With SymlinkFollow,
+	// links to directories are still stored as links, so that the walk
+	// never loops.
+	Symlink SymlinkPolicy
+
+	// Error is called when a file can't be read or has an unsupported
+	// type, e.g. a socket. The file is skipped if it returns nil; otherwise
+	// the walk stops with the returned error.
+	Error func(name string, err error) error
+
+	// Workers is the number of regular files opened and read ahead
+	// concurrently while earlier files are being written. Files are still
+	// added in the order of the walk. In this mode, Filter is called from
+	// the walking goroutine, while the other hooks are called from the
+	// caller's one.
+	Workers int
+}
+
+// DefaultFilter skips metadata files created by macOS, i.e. ".DS_Store"
+// and "._*".
+func DefaultFilter(name string, fi fs.FileInfo) bool {
+	base := BaseName(name)
+	return base != ".DS_Store" && !strings.HasPrefix(base, "._")
+}
+
+// AddDir adds the file tree rooted at root to the archive. The names in
+// the archive are the paths visited by filepath.Walk, i.e. with root as
+// the prefix, with '/' as the separator and leading slashes removed.
+func (w *Writer) AddDir(root string, opts *AddOptions) error {
+	if r := strings.TrimRight(root, "/"+string(filepath.Separator)); r != "" {
+		root = r
+	}
+	a := newAdder(w, opts, osSource{})
+	return a.run(func(visit visitFunc) error {
+		return filepath.Walk(root, func(p string, fi fs.FileInfo, err error) error {
+			name := strings.TrimLeft(filepath.ToSlash(p), "/")
+			if name == "" {
+				return err
+			}
+			return visit(p, name, fi, err)
+		})
+	})
+}
+
+// AddFS adds all files in fsys to the archive under the directory prefix.
+// If prefix is "", the files are added to the root.
+//
+// To store symbolic links, fsys must implement
+// ReadLink(name string) (string, error), as os.DirFS does since Go 1.25.
+func (w *Writer) AddFS(fsys fs.FS, prefix string, opts *AddOptions) error {
+	prefix = strings.Trim(prefix, "/")
+	a := newAdder(w, opts, fsSource{fsys})
+	return a.run(func(visit visitFunc) error {
+		return fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+			name := path.Join(prefix, p)
+			if p == "." && prefix == "" {
+				return err
+			}
+			var fi fs.FileInfo
+			if err == nil {
+				fi, err = d.Info()
+			}
+			return visit(p, name, fi, err)
+		})
+	})
+}
+
+// AddFile adds a file of another archive, keeping its name, mode and
+// modified time. The content is copied without being stored in memory.
+func (w *Writer) AddFile(f *File) error {
+	fw, err := w.CreateFile(f.Name, f.Mode(), f.ModTime())
+	if err != nil {
+		return err
+	}
+	if !f.IsDir() {
+		rf, err := f.reader.Open(f)
+		if err != nil {
+			fw.Abort()
+			return err
+		}
+		_, err = io.Copy(fw, rf)
+		rf.Close()
+		if err != nil {
+			fw.Abort()
+			return err
+		}
+	}
+	return fw.Close()
+}
+
+// addSource gives access to files visited by AddDir or AddFS.
+type addSource interface {
+	open(p string) (io.ReadCloser, error)
+	readlink(p string) (string, error)
+	stat(p string) (fs.FileInfo, error) // follows links
+}
+
+type osSource struct{}
+
+func (osSource) open(p string) (io.ReadCloser, error) { return os.Open(p) }
+func (osSource) readlink(p string) (string, error)    { return os.Readlink(p) }
+func (osSource) stat(p string) (fs.FileInfo, error)   { return os.Stat(p) }
+
+type fsSource struct {
+	fsys fs.FS
+}
+
+func (s fsSource) open(p string) (io.ReadCloser, error) { return s.fsys.Open(p) }
+func (s fsSource) stat(p string) (fs.FileInfo, error)   { return fs.Stat(s.fsys, p) }
+
+func (s fsSource) readlink(p string) (string, error) {
+	if fsys, ok := s.fsys.(interface {
+		ReadLink(name string) (string, error)
+	}); ok {
+		return fsys.ReadLink(p)
+	}
+	return "", &fs.PathError{Op: "readlink", Path: p, Err: errUnsupported}
+}
+
+type adder struct {
+	w    *Writer
+	opts AddOptions
+	src  addSource
+}
+
+func newAdder(w *Writer, opts *AddOptions, src addSource) *adder {
+	a := &adder{w: w, src: src}
+	if opts != nil {
+		a.opts = *opts
+	}
+	return a
+}
+
+func (a *adder) fail(name string, err error) error {
+	if a.opts.Error == nil {
+		return err
+	}
+	return a.opts.Error(name, err)
+}
+
+// visitFunc is called for each file visited by the walk, with p being
+// its path in the source.
+type visitFunc func(p, name string, fi fs.FileInfo, err error) error
+
+// run adds the files visited by walk.
+func (a *adder) run(walk func(visit visitFunc) error) error {
+	if a.opts.Workers > 1 {
+		return a.runPipeline(walk)
+	}
+	return walk(a.visit)
+}
+
+// filter reports whether to add the file, or fs.SkipDir if it's a
+// directory to skip.
+func (a *adder) filter(name string, fi fs.FileInfo) (bool, error) {
+	if a.opts.Filter != nil && !a.opts.Filter(name, fi) {
+		if fi.IsDir() {
+			return false, fs.SkipDir
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// visit adds the file at p of the source as name.
+func (a *adder) visit(p, name string, fi fs.FileInfo, err error) error {
+	if err != nil {
+		return a.fail(name, err)
+	}
+	if ok, err := a.filter(name, fi); !ok {
+		return err
+	}
+	return a.add(p, name, fi, a.src.open)
+}
+
+// add adds a file that passed the filter, opening regular files by open.
+func (a *adder) add(p, name string, fi fs.FileInfo, open func(p string) (io.ReadCloser, error)) error {
+	var err error
+
+	// Resolve symlink
+	mode := fi.Mode() & fs.ModeType
+	if mode == fs.ModeSymlink {
+		switch a.opts.Symlink {
+		case SymlinkSkip:
+			return nil
+		case SymlinkFollow:
+			target, err := a.src.stat(p)
+			if err != nil {
+				return a.fail(name, err)
+			}
+			if target.Mode().IsRegular() {
+				fi, mode = target, 0
+			}
+		}
+	}
+	if mode != 0 && mode != fs.ModeDir && mode != fs.ModeSymlink {
+		return a.fail(name, &fs.PathError{Op: "add", Path: name, Err: errUnsupported})
+	}
+
+	// Open source before creating the entry, so that unreadable files
+	// leave nothing in the archive
+	var r io.ReadCloser
+	var link string
+	switch mode {
+	case 0:
+		if r, err = open(p); err != nil {
+			return a.fail(name, err)
+		}
+		defer r.Close()
+	case fs.ModeSymlink:
+		if link, err = a.src.readlink(p); err != nil {
+			return a.fail(name, err)
+		}
+	}
+
+	if a.opts.Progress != nil {
+		a.opts.Progress(name, fi)
+	}
+	f, err := a.w.CreateFile(name, fi.Mode(), fi.ModTime())
+	if err != nil {
+		return err
+	}
+	switch mode {
+	case 0:
+		if _, err := copyProgress(f, r, a.opts.DataProgress); err != nil {
+			// Errors of writing the archive are fatal. Others are of
+			// reading the source, which only fail this file.
+			if f.(*wfileDesc).werr != nil {
+				return err
+			}
+			if aerr := f.Abort(); aerr != nil {
+				return aerr
+			}
+			return a.fail(name, err)
+		}
+	case fs.ModeSymlink:
+		if _, err := f.Write([]byte(link)); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// progressChunk is the most bytes copied between two calls of
+// DataProgress.
+const progressChunk = 1 << 20
+
+// copyProgress is like io.Copy, but reports the bytes copied to fn after
+// each chunk. Copying with io.CopyN, rather than through a wrapper of src,
+// keeps the copy_file_range path of the os package when src is a file.
+func copyProgress(dst io.Writer, src io.Reader, fn func(n int64)) (n int64, err error) {
+	if fn == nil {
+		return io.Copy(dst, src)
+	}
+	for {
+		m, err := io.CopyN(dst, src, progressChunk)
+		n += m
+		if m > 0 {
+			fn(m)
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package quicktar
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/fstest"
+)
+
+func TestDataProgress(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	sizes := []int{0, 1, progressChunk, 3*progressChunk + 7}
+	total := int64(0)
+	for i, size := range sizes {
+		p := filepath.Join(src, "d", string(rune('a'+i)))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		total += int64(size)
+	}
+
+	for _, cipher := range benchCiphers {
+		for _, workers := range []int{1, 4} {
+			name := filepath.Join(dir, "test.qtar")
+			w, err := NewWriter(name, cipher.cipher())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var added int64
+			err = w.AddDir(src, &AddOptions{
+				Workers: workers,
+				DataProgress: func(n int64) {
+					if n > progressChunk {
+						t.Errorf("reported %d bytes at once", n)
+					}
+					added += n
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if added != total {
+				t.Errorf("%s, %d workers: added %d bytes, want %d", cipher.name, workers, added, total)
+			}
+
+			r, err := OpenReader(name, cipher.cipher())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var written int64
+			err = r.Extract(filepath.Join(dir, "dst"), &ExtractOptions{
+				Workers:      workers,
+				DataProgress: func(n int64) { written += n },
+			})
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written != total {
+				t.Errorf("%s, %d workers: extracted %d bytes, want %d", cipher.name, workers, written, total)
+			}
+			os.RemoveAll(filepath.Join(dir, "dst"))
+		}
+	}
+}
+
+// errFS fails reading files named "bad" after a few bytes, reporting an
+// error with a path of its own, as os.DirFS does.
+type errFS struct {
+	fstest.MapFS
+}
+
+func (e errFS) Open(name string) (fs.File, error) {
+	f, err := e.MapFS.Open(name)
+	if err != nil || path.Base(name) != "bad" {
+		return f, err
+	}
+	return &errFile{File: f}, nil
+}
+
+type errFile struct {
+	fs.File
+	n int
+}
+
+func (f *errFile) Read(p []byte) (int, error) {
+	if f.n >= 10 {
+		return 0, &fs.PathError{Op: "read", Path: "/root/of/fs/bad", Err: syscall.EIO}
+	}
+	if len(p) > 10-f.n {
+		p = p[:10-f.n]
+	}
+	n, err := f.File.Read(p)
+	f.n += n
+	return n, err
+}
+
+func TestAddReadError(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789"), writeBufSize/5)
+	fsys := errFS{fstest.MapFS{
+		"d/a":   {Data: []byte("a")},
+		"d/bad": {Data: big},
+		"d/c":   {Data: big},
+	}}
+	for _, c := range benchCiphers {
+		for _, workers := range []int{1, 4} {
+			name := filepath.Join(t.TempDir(), "test.qtar")
+			w, err := NewWriter(name, c.cipher())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var failed []string
+			err = w.AddFS(fsys, "", &AddOptions{
+				Workers: workers,
+				Error: func(name string, err error) error {
+					failed = append(failed, name)
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("%s, %d workers: %v", c.name, workers, err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if len(failed) != 1 || failed[0] != "d/bad" {
+				t.Fatalf("%s, %d workers: failed %q", c.name, workers, failed)
+			}
+
+			r, err := OpenReader(name, c.cipher())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if errs := r.Validate(); errs != nil {
+				t.Errorf("%s, %d workers: %v", c.name, workers, errs)
+			}
+			var names []string
+			for _, f := range r.File {
+				names = append(names, f.Name)
+			}
+			if strings.Join(names, " ") != "d d/a d/c" {
+				t.Errorf("%s, %d workers: files %q", c.name, workers, names)
+			}
+			data := make([]byte, len(big))
+			if n, err := r.File[2].ReadAt(data, 0); n != len(big) || !bytes.Equal(data, big) {
+				t.Errorf("%s, %d workers: d/c has wrong content: %v", c.name, workers, err)
+			}
+			r.Close()
+		}
+	}
+}
+
+func TestAddWriteError(t *testing.T) {
+	fsys := fstest.MapFS{"big": {Data: make([]byte, 2*writeBufSize)}}
+	for _, c := range benchCiphers {
+		name := filepath.Join(t.TempDir(), "test.qtar")
+		w, err := NewWriter(name, c.cipher())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Writing the archive fails, which isn't an error of the source
+		fd := w.fd
+		if w.fd, err = os.Open(name); err != nil {
+			t.Fatal(err)
+		}
+		err = w.AddFS(fsys, "", &AddOptions{
+			Error: func(name string, err error) error {
+				t.Errorf("%s: Error called with %s: %v", c.name, name, err)
+				return nil
+			},
+		})
+		if err == nil {
+			t.Errorf("%s: AddFS succeeded", c.name)
+		}
+		w.fd.Close()
+		w.fd = fd
+		w.Close()
+	}
+}
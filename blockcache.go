@@ -0,0 +1,121 @@
+package quicktar
+
+import (
+	"io"
+	"io/fs"
+	"sync"
+)
+
+const (
+	// cacheBlockSize is the granularity of blockCache.
+	// It must be a multiple of 16 so that each block decrypts on its own.
+	cacheBlockSize = 64 << 10
+
+	// maxReadahead is the maximum number of blocks read ahead at once.
+	maxReadahead = 32
+)
+
+// blockCache caches decrypted blocks of an archive.
+// Block k covers [k*cacheBlockSize, (k+1)*cacheBlockSize) of the archive.
+type blockCache struct {
+	mux sync.Mutex
+	lru *lru[int64, []byte]
+}
+
+func newBlockCache(size int64) *blockCache {
+	return &blockCache{lru: newLRU[int64, []byte](size)}
+}
+
+func (c *blockCache) get(k int64) ([]byte, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.lru.get(k)
+}
+
+func (c *blockCache) add(k int64, blk []byte) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.lru.add(k, blk, int64(len(blk)))
+}
+
+// SetBlockCacheSize sets the size in bytes of the decrypted block cache,
+// which is shared by all files of r. Zero disables the cache (default).
+//
+// With the cache enabled, sequential reads on a FileDesc also read ahead
+// a growing number of blocks, so that small reads cost few syscalls.
+func (r *Reader) SetBlockCacheSize(size int64) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if size <= 0 {
+		r.cache = nil
+		return
+	}
+	r.cache = newBlockCache(size)
+}
+
+// readCached is like readAt but reads through cache. Up to ra extra
+// blocks within f are loaded when a block is missing.
+func (r *Reader) readCached(cache *blockCache, f *File, p []byte, off int64, ra int) (n int, err error) {
+	if off < 0 {
+		return 0, fs.ErrInvalid
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	if off+int64(len(p)) > f.size {
+		p = p[:f.size-off]
+		err = io.EOF
+	}
+
+	start := f.offset + off
+	lastBlk := (f.offset + f.size - 1) / cacheBlockSize
+	for n < len(p) {
+		pos := start + int64(n)
+		k := pos / cacheBlockSize
+		blk, ok := cache.get(k)
+		if !ok {
+			cnt := int64(1 + ra)
+			if k+cnt > lastBlk+1 {
+				cnt = lastBlk + 1 - k
+			}
+			var lerr error
+			if blk, lerr = r.loadBlocks(cache, k, cnt); lerr != nil {
+				return n, lerr
+			}
+		}
+		i := pos - k*cacheBlockSize
+		if i >= int64(len(blk)) {
+			return n, io.ErrUnexpectedEOF
+		}
+		n += copy(p[n:], blk[i:])
+	}
+	return n, err
+}
+
+// loadBlocks reads cnt blocks starting from k with one syscall,
+// puts them into cache and returns block k. Each block is copied to its
+// own allocation, so that a cached block doesn't keep the others alive.
+func (r *Reader) loadBlocks(cache *blockCache, k, cnt int64) ([]byte, error) {
+	buf := make([]byte, cnt*cacheBlockSize)
+	m, err := r.pread(buf, k*cacheBlockSize)
+	if err != nil && !(err == io.EOF && m > 0) {
+		return nil, err
+	}
+	buf = buf[:m]
+	r.xorKeyStream(buf, buf, k*cacheBlockSize)
+
+	var first []byte
+	for i := int64(0); i < cnt && len(buf) > 0; i++ {
+		size := len(buf)
+		if size > cacheBlockSize {
+			size = cacheBlockSize
+		}
+		blk := append([]byte(nil), buf[:size]...)
+		buf = buf[size:]
+		cache.add(k+i, blk)
+		if i == 0 {
+			first = blk
+		}
+	}
+	return first, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+
+	ctr "github.com/lshpku/quicktar"
+)
+
+func cat() {
+	if len(flagFiles) == 0 {
+		fatalWithUsage("requires files to cat")
+	}
+
+	// Open reader
+	cpr := ctr.NewCipher(flagEnc, flagPwd)
+	r, err := ctr.OpenReader(*flagPath, cpr)
+	nilOrFatal(err)
+	defer r.Close()
+
+	// Find files before writing anything
+	files := make([]*ctr.File, 0, len(flagFiles))
+	for _, name := range flagFiles {
+		name = strings.Trim(name, "/")
+		if !strings.ContainsAny(name, `*?[\`) {
+			f, err := r.Lookup(name)
+			nilOrFatal(err)
+			files = append(files, f)
+			continue
+		}
+		matches, err := r.Glob(name)
+		if err != nil {
+			fatal("bad pattern: " + name)
+		}
+		n := len(files)
+		for _, f := range matches {
+			if f.Mode().IsRegular() {
+				files = append(files, f)
+			}
+		}
+		if len(files) == n {
+			fatal(name + ": no regular file matched")
+		}
+	}
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			fatal(f.Name + ": not a regular file")
+		}
+	}
+
+	out := bufio.NewWriterSize(os.Stdout, 1<<20)
+	for _, f := range files {
+		fd, err := r.Open(f)
+		nilOrFatal(err)
+		var src io.Reader = fd
+		if flagOffset > 0 || flagLength >= 0 {
+			length := f.Size() - flagOffset
+			if length < 0 {
+				length = 0
+			}
+			if flagLength >= 0 && flagLength < length {
+				length = flagLength
+			}
+			src = io.NewSectionReader(fd, flagOffset, length)
+		}
+		_, err = io.Copy(out, src)
+		fd.Close()
+		nilOrFatal(err)
+	}
+	nilOrFatal(out.Flush())
+}
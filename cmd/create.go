@@ -3,11 +3,9 @@ package main
 import (
 	"errors"
 	"fmt"
-	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
-	"strings"
 
 	ctr "github.com/lshpku/quicktar"
 )
@@ -34,97 +32,71 @@ func create(append bool) {
 		w, err = ctr.NewWriterFile(f, ctr.NewCipherNonce(flagEnc, flagPwd, nil))
 	}
 	nilOrFatal(err)
+	if flagIndex {
+		w.SetMetaIndex(true)
+	}
 
-	visit := func(path string, fi fs.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Filter file
-		mode := fi.Mode() & fs.ModeType
-		if mode != 0 && mode != fs.ModeDir && mode != fs.ModeSymlink {
-			fmt.Fprintf(os.Stderr, "warning: unsupported file: %s\n", path)
-			return nil
-		}
-		baseName := ctr.BaseName(path)
-		if baseName == ".DS_Store" {
-			return nil
-		}
-		if strings.HasPrefix(baseName, "._") {
-			return nil
-		}
-
-		if flagVerbose {
-			name := path
-			if fi.IsDir() {
-				name += "/"
-			}
-			fmt.Println(name)
-		}
-
-		// Create entry in archive
-		w, err := w.CreateFile(path, fi.Mode(), fi.ModTime())
-		if err != nil {
-			return err
-		}
-		defer w.Close()
+	prog := newProgress()
 
-		// 1. Directory
-		if fi.IsDir() {
-			return nil
-		}
-
-		// 2. Symlink
-		if mode == fs.ModeSymlink {
-			link, err := os.Readlink(path)
-			if err != nil {
-				return err
-			}
-			if _, err := w.Write([]byte(link)); err != nil {
-				return err
+	opts := &ctr.AddOptions{
+		Filter: ctr.DefaultFilter,
+		Progress: func(name string, fi fs.FileInfo) {
+			prog.addFile()
+			if flagVerbose {
+				if fi.IsDir() {
+					name += "/"
+				}
+				fmt.Println(name)
 			}
+		},
+		Error: func(name string, err error) error {
+			// Skip unreadable or unsupported files
+			fmt.Fprintf(os.Stderr, "warning: %s\n", err)
 			return nil
-		}
-
-		// 3. Regular file
-		if mode == 0 {
-			r, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			_, err = io.Copy(w, r)
-			r.Close()
-			return err
-		}
-
-		println("ignored:", path)
-		return nil
+		},
+		Workers: flagJobs,
+	}
+	if prog != nil {
+		prog.setTotal(scan())
+		opts.DataProgress = prog.addBytes
 	}
 
 	// Traverse files
 	for _, root := range flagFiles {
-		var fi fs.FileInfo
-		fi, err = os.Stat(root)
-		if err != nil {
+		if _, err = os.Stat(root); err != nil {
 			break
 		}
-		if fi.IsDir() {
-			lastChar := rune(0)
-			for _, c := range root {
-				lastChar = c
-			}
-			if lastChar == '/' {
-				root = root[:len(root)-1]
-			}
-		}
-		err = filepath.Walk(root, visit)
-		if err != nil {
+		if err = w.AddDir(root, opts); err != nil {
 			break
 		}
 	}
 
 	// Close the file before raising any error, so that the archive is closed properly.
 	closeErr := w.Close()
+	prog.finish()
 	nilOrFatal(err)
 	nilOrFatal(closeErr)
 }
+
+// scan returns the total size and number of files to add.
+func scan() (size int64, count int) {
+	for _, root := range flagFiles {
+		filepath.Walk(root, func(p string, fi fs.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if !ctr.DefaultFilter(p, fi) {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if fi.Mode().IsRegular() {
+				size += fi.Size()
+			}
+			count++
+			return nil
+		})
+	}
+	return size, count
+}
@@ -2,9 +2,8 @@ package main
 
 import (
 	"fmt"
-	"io"
-	"io/fs"
 	"os"
+	"path/filepath"
 	"strconv"
 
 	ctr "github.com/lshpku/quicktar"
@@ -15,10 +14,26 @@ func list() {
 	cpr := ctr.NewCipher(flagEnc, flagPwd)
 	r, err := ctr.OpenReader(*flagPath, cpr)
 	nilOrFatal(err)
+	defer r.Close()
+
+	// Select files
+	sel := newSelector(r.File)
+	files := make([]*ctr.File, 0, len(r.File))
+	for _, f := range r.File {
+		if sel.selected(f) && ctr.StripComponents(f.Name, flagStrip) != "" {
+			files = append(files, f)
+		}
+	}
+
+	if flagFormat != "" {
+		printList(files)
+		sel.warnUnused()
+		return
+	}
 
 	// Find the longest size
 	maxSize := int64(0)
-	for _, f := range r.File {
+	for _, f := range files {
 		if f.Size() > maxSize {
 			maxSize = f.Size()
 		}
@@ -26,8 +41,8 @@ func list() {
 	sizeLen := len(strconv.FormatInt(maxSize, 10))
 
 	// Print files
-	for _, f := range r.File {
-		name := f.Name
+	for _, f := range files {
+		name := ctr.StripComponents(f.Name, flagStrip)
 		if f.IsDir() {
 			name += "/"
 		}
@@ -39,6 +54,7 @@ func list() {
 		modTime := f.ModTime().Format("2006/01/02 15:04")
 		fmt.Printf("%s %*d %s %s\n", mode, sizeLen, f.Size(), modTime, name)
 	}
+	sel.warnUnused()
 }
 
 func extract() {
@@ -46,103 +62,92 @@ func extract() {
 	cpr := ctr.NewCipher(flagEnc, flagPwd)
 	r, err := ctr.OpenReader(*flagPath, cpr)
 	nilOrFatal(err)
+	defer r.Close()
 
-	dirMap := map[string]*ctr.File{}
-	dirLastIdx := map[string]int{}
-	dirExists := map[string]bool{}
-
-	// Find the last indices of directories
-	for i, f := range r.File {
-		for _, p := range ctr.Parents(f.Name) {
-			dirLastIdx[p] = i
-		}
-		if f.IsDir() {
-			dirMap[f.Name] = f
-			dirLastIdx[f.Name] = i
+	sel := newSelector(r.File)
+	opts := ctr.ExtractOptions{
+		Filter:          sel.selected,
+		StripComponents: flagStrip,
+		Workers:         flagJobs,
+	}
+	if flagPolicy != nil {
+		switch *flagPolicy {
+		case "skip-existing":
+			opts.Overwrite = ctr.OverwriteSkip
+		case "keep-newer":
+			opts.Overwrite = ctr.OverwriteKeepNewer
+		case "backup":
+			opts.Overwrite = ctr.OverwriteBackup
 		}
 	}
 
-	createBasedir := func(path string) {
-		parents := ctr.Parents(path)
-		if len(parents) == 0 {
-			return
+	// Plan the extraction to check for free space before writing
+	need, count := int64(0), 0
+	plan := opts
+	plan.DryRun = true
+	plan.Plan = func(f *ctr.File, path string, act ctr.ExtractAction) {
+		if act != ctr.ActionSkip && f.Mode().IsRegular() {
+			need += f.Size()
 		}
-		dirname := parents[len(parents)-1]
-		if dirExists[dirname] {
-			return
-		}
-		nilOrFatal(os.MkdirAll(dirname, 0755))
-		for _, p := range parents {
-			dirExists[p] = true
+		count++
+		if flagDryRun {
+			fmt.Printf("%-7s %s\n", act, displayName(f))
 		}
 	}
+	nilOrFatal(r.Extract(flagDir, &plan))
+	checkFree(need)
+	if flagDryRun {
+		sel.warnUnused()
+		return
+	}
 
-	for i, f := range r.File {
-		mode := f.Mode() & fs.ModeType
-
-		// 1. Regular file
-		if mode == 0 {
-			if flagVerbose {
-				fmt.Println(f.Name)
-			}
-
-			// Create parent directories
-			createBasedir(f.Name)
-
-			// Extract file
-			rf, err := r.Open(f)
-			nilOrFatal(err)
-			wf, err := os.OpenFile(f.Name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-			nilOrFatal(err)
-			_, err = io.Copy(wf, rf)
-			nilOrFatal(err)
-			rf.Close()
-
-			// Set file metadata
-			nilOrFatal(wf.Chmod(f.Mode()))
-			nilOrFatal(wf.Close())
-			nilOrFatal(os.Chtimes(f.Name, f.ModTime(), f.ModTime()))
+	prog := newProgress()
+	if prog != nil {
+		prog.setTotal(need, count)
+		opts.DataProgress = prog.addBytes
+	}
+	opts.Before = func(f *ctr.File, path string) error {
+		prog.addFile()
+		if flagVerbose {
+			fmt.Println(displayName(f))
 		}
+		return nil
+	}
+	err = r.Extract(flagDir, &opts)
+	prog.finish()
+	nilOrFatal(err)
+	sel.warnUnused()
+}
 
-		// 2. Symlink
-		if mode == fs.ModeSymlink {
-			if flagVerbose {
-				fmt.Println(f.Name)
-			}
-			createBasedir(f.Name)
-			rf, err := r.Open(f)
-			nilOrFatal(err)
-			data, err := io.ReadAll(rf)
-			nilOrFatal(err)
-			nilOrFatal(os.Symlink(string(data), f.Name))
-			// Note: ignore mode or modTime for symlink
-		}
+func displayName(f *ctr.File) string {
+	if f.IsDir() {
+		return f.Name + "/"
+	}
+	return f.Name
+}
 
-		// 3. Empty directory
-		if f.IsDir() && dirLastIdx[f.Name] == i {
-			if flagVerbose {
-				fmt.Println(f.Name + "/")
-			}
-			// Note: use MkdirAll to avoid 'file exists' error.
-			nilOrFatal(os.MkdirAll(f.Name, 0755))
-			for _, p := range ctr.Parents(f.Name) {
-				dirExists[p] = true
-			}
-			nilOrFatal(os.Chmod(f.Name, f.Mode()))
-			nilOrFatal(os.Chtimes(f.Name, f.ModTime(), f.ModTime()))
+// checkFree exits if the target directory has less than need bytes free.
+// The check is skipped if the free space is unknown.
+func checkFree(need int64) {
+	dir := flagDir
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
 		}
-
-		// 4. Parent directories
-		for _, p := range ctr.Parents(f.Name) {
-			if dirLastIdx[p] == i {
-				if df, ok := dirMap[p]; ok {
-					if flagVerbose {
-						fmt.Println(p + "/")
-					}
-					nilOrFatal(os.Chmod(p, df.Mode()))
-					nilOrFatal(os.Chtimes(p, df.ModTime(), df.ModTime()))
-				}
-			}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
 		}
+		dir = parent
+	}
+	free, err := diskFree(dir)
+	if err != nil {
+		return
+	}
+	if flagDryRun {
+		fmt.Printf("%d bytes to write, %d bytes free\n", need, free)
+	}
+	if need > free {
+		fatal(fmt.Sprintf("not enough space: %d bytes to write, %d bytes free", need, free))
 	}
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"time"
+
+	ctr "github.com/lshpku/quicktar"
+)
+
+type listEntry struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Size    int64  `json:"size"`
+	Mode    string `json:"mode"`
+	ModTime string `json:"mtime"`
+	Offset  int64  `json:"offset"`
+}
+
+func fileType(mode fs.FileMode) string {
+	switch mode & fs.ModeType {
+	case 0:
+		return "file"
+	case fs.ModeDir:
+		return "dir"
+	case fs.ModeSymlink:
+		return "symlink"
+	}
+	return "other"
+}
+
+func newListEntry(f *ctr.File) *listEntry {
+	return &listEntry{
+		Name:    ctr.StripComponents(f.Name, flagStrip),
+		Type:    fileType(f.Mode()),
+		Size:    f.Size(),
+		Mode:    fmt.Sprintf("%04o", f.Mode().Perm()),
+		ModTime: f.ModTime().Format(time.RFC3339Nano),
+		Offset:  f.Offset(),
+	}
+}
+
+// printList prints files in the format given by --format.
+func printList(files []*ctr.File) {
+	switch flagFormat {
+	case "json":
+		entries := make([]*listEntry, len(files))
+		for i, f := range files {
+			entries[i] = newListEntry(f)
+		}
+		nilOrFatal(json.NewEncoder(os.Stdout).Encode(entries))
+
+	case "jsonl":
+		enc := json.NewEncoder(os.Stdout)
+		for _, f := range files {
+			nilOrFatal(enc.Encode(newListEntry(f)))
+		}
+
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"name", "type", "size", "mode", "mtime", "offset"})
+		for _, f := range files {
+			e := newListEntry(f)
+			w.Write([]string{e.Name, e.Type, strconv.FormatInt(e.Size, 10),
+				e.Mode, e.ModTime, strconv.FormatInt(e.Offset, 10)})
+		}
+		w.Flush()
+		nilOrFatal(w.Error())
+
+	case "null":
+		for _, f := range files {
+			name := ctr.StripComponents(f.Name, flagStrip)
+			if f.IsDir() {
+				name += "/"
+			}
+			fmt.Print(name, "\x00")
+		}
+	}
+}
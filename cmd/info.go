@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+
+	ctr "github.com/lshpku/quicktar"
+)
+
+type archiveInfo struct {
+	Path        string         `json:"path"`
+	Format      string         `json:"format"`
+	Encryption  string         `json:"encryption"`
+	Nonce       string         `json:"nonce,omitempty"`
+	DataStart   int64          `json:"data_start"`
+	MetaStart   int64          `json:"meta_start"`
+	MetaEnd     int64          `json:"meta_end"`
+	MetaSize    int64          `json:"meta_size"`
+	Indexed     bool           `json:"indexed"`
+	Entries     int            `json:"entries"`
+	Types       map[string]int `json:"types"`
+	DataSize    int64          `json:"data_size"`   // size of the data region
+	UsedSize    int64          `json:"used_size"`   // total size of contents
+	Utilization float64        `json:"utilization"` // used_size / data_size
+}
+
+func info() {
+	if flagFormat != "" && flagFormat != "json" {
+		fatalWithUsage("unsupported format for info: " + flagFormat)
+	}
+
+	// Open reader
+	cpr := ctr.NewCipher(flagEnc, flagPwd)
+	r, err := ctr.OpenReader(*flagPath, cpr)
+	nilOrFatal(err)
+	defer r.Close()
+
+	ri := r.Info()
+	a := &archiveInfo{
+		Path:       *flagPath,
+		Format:     "current",
+		Encryption: "none",
+		DataStart:  ri.DataStart,
+		MetaStart:  ri.MetaStart,
+		MetaEnd:    ri.MetaEnd,
+		MetaSize:   ri.MetaEnd - ri.MetaStart,
+		Indexed:    ri.Indexed,
+		Entries:    ri.Count,
+		Types:      map[string]int{},
+		DataSize:   ri.MetaStart - ri.DataStart,
+	}
+	if ri.Legacy {
+		a.Format = "legacy"
+	}
+	if ri.Encrypted {
+		a.Encryption = fmt.Sprintf("aes-%d", 64+64*flagEnc)
+		a.Nonce = hex.EncodeToString(ri.Nonce)
+	}
+	for _, f := range r.File {
+		a.Types[fileType(f.Mode())]++
+		if f.Mode()&fs.ModeDir == 0 {
+			a.UsedSize += f.Size()
+		}
+	}
+	if a.DataSize > 0 {
+		a.Utilization = float64(a.UsedSize) / float64(a.DataSize)
+	}
+
+	if flagFormat == "json" {
+		nilOrFatal(json.NewEncoder(os.Stdout).Encode(a))
+		return
+	}
+	fmt.Printf("path:        %s\n", a.Path)
+	fmt.Printf("format:      %s\n", a.Format)
+	fmt.Printf("encryption:  %s\n", a.Encryption)
+	if a.Nonce != "" {
+		fmt.Printf("nonce:       %s\n", a.Nonce)
+	}
+	fmt.Printf("data:        %d-%d (%s)\n", a.DataStart, a.MetaStart, formatSize(a.DataSize))
+	fmt.Printf("meta:        %d-%d (%s)\n", a.MetaStart, a.MetaEnd, formatSize(a.MetaSize))
+	fmt.Printf("index:       %t\n", a.Indexed)
+	fmt.Printf("entries:     %d (%d files, %d dirs, %d symlinks, %d other)\n", a.Entries,
+		a.Types["file"], a.Types["dir"], a.Types["symlink"], a.Types["other"])
+	fmt.Printf("utilization: %s of data used (%.1f%%)\n", formatSize(a.UsedSize), a.Utilization*100)
+}
+
+func check() {
+	// Open reader
+	cpr := ctr.NewCipher(flagEnc, flagPwd)
+	r, err := ctr.OpenReader(*flagPath, cpr)
+	nilOrFatal(err)
+	defer r.Close()
+
+	errs := r.Validate()
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+	if len(errs) > 0 {
+		r.Close()
+		fatal(fmt.Sprintf("%d problems found", len(errs)))
+	}
+	if flagVerbose {
+		fmt.Println("ok")
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 
 	ctr "github.com/lshpku/quicktar"
@@ -15,10 +16,40 @@ Options:
     -a, --append          Append to an existing archive.
     -x, --extract         Extract the archive.
     -t, --list            List files in the archive.
+    -O, --cat             Write the contents of files to stdout.
+        --info            Describe the layout of the archive.
+        --check           Check the structure of the archive.
+        --migrate         Convert an archive of the older format to a new
+                          archive, given as the file, with a fresh nonce.
+        --rekey           Re-encrypt the archive in place, or to a new
+                          archive if given as the file, with a fresh nonce.
+        --new-level <n>   Set encryption level 0-3 on rekey, where 0 decrypts
+                          the archive (default the old level).
+        --new-password <str>
+                          Set password on rekey (default the old one).
     -f, --file <str>      Set the archive file.
+    -C, --directory <str> Extract into the directory (default .).
     -v, --verbose         Verbosely list files processed.
+    -j, --jobs <n>        Read or extract n files in parallel (default 1).
     -1, -2, -3            Set encryption level (default none).
     -p, --password <str>  Set password.
+        --index           Write a meta index for fast lookup on create.
+        --strip-components <n>
+                          Strip n leading levels from names on extract or list.
+        --regex           Select files by regexps rather than globs.
+        --overwrite       Replace existing files on extract (default).
+        --skip-existing   Keep existing files on extract.
+        --keep-newer      Keep existing files newer than those in the archive.
+        --backup          Rename existing files with suffix '~' on extract.
+        --dry-run         Print what extract would do without writing.
+        --progress-fd <n> Write progress as JSON lines to file descriptor n.
+        --format <str>    Set the output format of list: json, jsonl, csv or
+                          null (names terminated by NUL), or of info: json.
+        --offset <n>      Start at byte n of each file on cat.
+        --length <n>      Write at most n bytes of each file on cat.
+
+On create or append, files are the paths to add. On extract or list, they
+select members by name or glob, where a directory selects its contents.
 `
 
 func printHelpAndExit() {
@@ -45,18 +76,39 @@ func nilOrFatal(err error) {
 }
 
 var (
-	flagMode    string
-	flagPath    *string
-	flagVerbose bool
-	flagEnc     int
-	flagPwd     []byte
-	flagFiles   = make([]string, 0)
+	flagMode       string
+	flagPath       *string
+	flagVerbose    bool
+	flagIndex      bool
+	flagDir        = "."
+	flagStrip      int
+	flagRegex      bool
+	flagPolicy     *string
+	flagDryRun     bool
+	flagJobs       = 1
+	flagProgressFd = -1
+	flagFormat     string
+	flagOffset     int64
+	flagLength     int64 = -1
+	flagNewEnc     int   = -1 // the old level if not given
+	flagNewPwd     []byte
+	flagEnc        int
+	flagPwd        []byte
+	flagFiles      = make([]string, 0)
 )
 
+func parseJobs(s, name string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		fatalWithUsage("invalid value for " + name)
+	}
+	return n
+}
+
 func main() {
 	// Helper functions for parsing arguments
 	i := 1
-	var pwd *string
+	var pwd, newPwd *string
 	argc := len(os.Args)
 	shift := func(name string) string {
 		if i+1 == argc {
@@ -80,7 +132,7 @@ func main() {
 			switch arg[2:] {
 			case "help":
 				printHelpAndExit()
-			case "create", "append", "extract", "list":
+			case "create", "append", "extract", "list", "cat", "info", "check", "migrate", "rekey":
 				if flagMode != "" {
 					fatalWithUsage("ambiguous operation")
 				}
@@ -89,6 +141,55 @@ func main() {
 				flagPath = once(flagPath, shift(arg), "file")
 			case "verbose":
 				flagVerbose = true
+			case "index":
+				flagIndex = true
+			case "directory":
+				flagDir = shift(arg)
+			case "strip-components":
+				n, err := strconv.Atoi(shift(arg))
+				if err != nil || n < 0 {
+					fatalWithUsage("invalid value for " + arg)
+				}
+				flagStrip = n
+			case "regex":
+				flagRegex = true
+			case "overwrite", "skip-existing", "keep-newer", "backup":
+				flagPolicy = once(flagPolicy, arg[2:], "overwrite policy")
+			case "dry-run":
+				flagDryRun = true
+			case "jobs":
+				flagJobs = parseJobs(shift(arg), arg)
+			case "format":
+				flagFormat = shift(arg)
+				switch flagFormat {
+				case "json", "jsonl", "csv", "null":
+				default:
+					fatalWithUsage("unknown format: " + flagFormat)
+				}
+			case "offset", "length":
+				n, err := strconv.ParseInt(shift(arg), 10, 64)
+				if err != nil || n < 0 {
+					fatalWithUsage("invalid value for " + arg)
+				}
+				if arg == "--offset" {
+					flagOffset = n
+				} else {
+					flagLength = n
+				}
+			case "new-level":
+				n, err := strconv.Atoi(shift(arg))
+				if err != nil || n < ctr.EncNone || n > ctr.EncAES256 {
+					fatalWithUsage("invalid value for " + arg)
+				}
+				flagNewEnc = n
+			case "new-password":
+				newPwd = once(newPwd, shift(arg), "new password")
+			case "progress-fd":
+				n, err := strconv.Atoi(shift(arg))
+				if err != nil || n < 0 {
+					fatalWithUsage("invalid value for " + arg)
+				}
+				flagProgressFd = n
 			case "password":
 				pwd = once(pwd, shift(arg), "password")
 			default:
@@ -104,7 +205,7 @@ func main() {
 				switch arg[j : j+1] {
 				case "h":
 					printHelpAndExit()
-				case "c", "a", "x", "t":
+				case "c", "a", "x", "t", "O":
 					if flagMode != "" {
 						fatalWithUsage("ambiguous operation")
 					}
@@ -123,6 +224,20 @@ func main() {
 						flagPath = once(flagPath, arg[j+1:], "file")
 						j = nargs
 					}
+				case "C":
+					if j+1 == nargs {
+						flagDir = shift("-C")
+					} else {
+						flagDir = arg[j+1:]
+						j = nargs
+					}
+				case "j":
+					if j+1 == nargs {
+						flagJobs = parseJobs(shift("-j"), "-j")
+					} else {
+						flagJobs = parseJobs(arg[j+1:], "-j")
+						j = nargs
+					}
 				case "p":
 					if j+1 == nargs {
 						pwd = once(pwd, shift("-p"), "password")
@@ -155,6 +270,21 @@ func main() {
 		}
 		flagPwd = []byte(*pwd)
 	}
+	if flagNewEnc < 0 {
+		flagNewEnc = flagEnc
+	}
+	if flagNewEnc == ctr.EncNone && newPwd != nil {
+		fatalWithUsage("new password given without encryption")
+	}
+	if flagNewEnc != ctr.EncNone {
+		if newPwd == nil {
+			newPwd = pwd
+		}
+		if newPwd == nil {
+			fatalWithUsage("requires new password on encryption")
+		}
+		flagNewPwd = []byte(*newPwd)
+	}
 
 	// Apply operation
 	switch flagMode {
@@ -166,5 +296,15 @@ func main() {
 		extract()
 	case "t", "list":
 		list()
+	case "O", "cat":
+		cat()
+	case "info":
+		info()
+	case "check":
+		check()
+	case "migrate":
+		migrate()
+	case "rekey":
+		rekey()
 	}
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	ctr "github.com/lshpku/quicktar"
+)
+
+func migrate() {
+	if len(flagFiles) != 1 {
+		fatalWithUsage("requires exactly one new archive")
+	}
+
+	// Open reader
+	cpr := ctr.NewCipher(flagEnc, flagPwd)
+	r, err := ctr.OpenReader(*flagPath, cpr)
+	nilOrFatal(err)
+	defer r.Close()
+	if !r.Info().Legacy {
+		r.Close()
+		fatal(*flagPath + ": already in the current format")
+	}
+
+	nilOrFatal(copyArchive(r, flagFiles[0], ctr.NewCipherNonce(flagEnc, flagPwd, nil)))
+}
+
+func rekey() {
+	if len(flagFiles) > 1 {
+		fatalWithUsage("requires at most one new archive")
+	}
+	old := ctr.NewCipher(flagEnc, flagPwd)
+	new := ctr.NewCipherNonce(flagNewEnc, flagNewPwd, nil)
+
+	// Rekey in place
+	if len(flagFiles) == 0 {
+		err := ctr.Rekey(*flagPath, old, new)
+		if errors.Is(err, ctr.ErrBadMagic) {
+			fatal(*flagPath + ": older format, which should be migrated first")
+		}
+		nilOrFatal(err)
+		return
+	}
+
+	// Rekey to a new archive
+	r, err := ctr.OpenReader(*flagPath, old)
+	nilOrFatal(err)
+	defer r.Close()
+	nilOrFatal(copyArchive(r, flagFiles[0], new))
+}
+
+// copyArchive copies all files of r to a new archive at dst encrypted by
+// cpr, which should have a fresh nonce, and verifies the copy. The archive
+// is written to a temporary file, which is synced and then moved to dst
+// on success, so that dst is never left incomplete, even by a crash, and
+// an existing dst is never replaced. The temporary file has a unique name,
+// so that one left by a crash doesn't block a retry.
+func copyArchive(r *ctr.Reader, dst string, cpr ctr.Cipher) error {
+	f, err := os.CreateTemp(filepath.Dir(dst), ".quicktar-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	// CreateTemp makes the file private, unlike other new archives
+	err = f.Chmod(0644)
+	var w *ctr.Writer
+	if err == nil {
+		w, err = ctr.NewWriterFile(f, cpr)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if flagIndex {
+		w.SetMetaIndex(true)
+	}
+
+	files := lastFiles(r.File)
+	for _, file := range files {
+		if flagVerbose {
+			fmt.Println(displayName(file))
+		}
+		if err = w.AddFile(file); err != nil {
+			break
+		}
+	}
+
+	// Close the file before raising any error, so that the archive is closed properly.
+	closeErr := w.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = verifyCopy(r, files, tmp, cpr)
+	}
+	if err == nil {
+		err = syncFile(tmp)
+	}
+	if err == nil {
+		err = publish(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return ctr.SyncDir(dst)
+}
+
+// publish moves tmp to dst, failing if dst exists. A hard link does both
+// at once. Where links aren't supported, e.g. on FAT, dst is checked
+// before a rename instead, which could still replace a file created in
+// between.
+func publish(tmp, dst string) error {
+	errExist := &fs.PathError{Op: "create", Path: dst, Err: fs.ErrExist}
+	err := os.Link(tmp, dst)
+	if err == nil {
+		return os.Remove(tmp)
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return errExist
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return errExist
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// syncFile flushes the file at name to disk.
+func syncFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// verifyCopy checks that the archive at dst has the same files as files
+// of r.
+func verifyCopy(r *ctr.Reader, files []*ctr.File, dst string, cpr ctr.Cipher) error {
+	v, err := ctr.OpenReader(dst, cpr)
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	want := make(map[string]*ctr.File, len(files))
+	for _, f := range files {
+		want[f.Name] = f
+	}
+	if len(v.File) != len(want) {
+		return fmt.Errorf("verify: %d files copied, expected %d", len(v.File), len(want))
+	}
+	for _, got := range v.File {
+		f := want[got.Name]
+		if f == nil {
+			return fmt.Errorf("verify: %s: unexpected file", got.Name)
+		}
+		if got.Mode() != f.Mode() || !got.ModTime().Equal(f.ModTime()) || got.Size() != f.Size() {
+			return fmt.Errorf("verify: %s: metadata differs", got.Name)
+		}
+		if f.IsDir() {
+			continue
+		}
+		if err := compareFiles(r, f, v, got); err != nil {
+			return fmt.Errorf("verify: %s: %w", got.Name, err)
+		}
+	}
+	return nil
+}
+
+// lastFiles drops files whose name appears again later, since later files
+// replace earlier ones on extract. Older archives may have such files,
+// which can't be added to a new archive.
+func lastFiles(files []*ctr.File) []*ctr.File {
+	last := make(map[string]int, len(files))
+	for i, f := range files {
+		last[f.Name] = i
+	}
+	if len(last) == len(files) {
+		return files
+	}
+	kept := make([]*ctr.File, 0, len(last))
+	for i, f := range files {
+		if last[f.Name] == i {
+			kept = append(kept, f)
+		} else {
+			fmt.Fprintf(os.Stderr, "warning: %s: duplicate name, keeping the last one\n", f.Name)
+		}
+	}
+	return kept
+}
+
+var errContentDiffers = errors.New("content differs")
+
+func compareFiles(ra *ctr.Reader, a *ctr.File, rb *ctr.Reader, b *ctr.File) error {
+	fa, err := ra.Open(a)
+	if err != nil {
+		return err
+	}
+	defer fa.Close()
+	fb, err := rb.Open(b)
+	if err != nil {
+		return err
+	}
+	defer fb.Close()
+
+	bufA := make([]byte, 1<<20)
+	bufB := make([]byte, 1<<20)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return errContentDiffers
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			if errB == io.EOF || errB == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return errContentDiffers
+		}
+		if errA != nil {
+			return errA
+		}
+		if errB != nil && errB != io.ErrUnexpectedEOF && errB != io.EOF {
+			return errB
+		}
+	}
+}
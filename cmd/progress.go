@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// progressInterval is the minimum interval between two reports.
+const progressInterval = 200 * time.Millisecond
+
+// progress reports the bytes and files done to stderr if it's a terminal,
+// and as JSON lines to the file descriptor given by --progress-fd.
+type progress struct {
+	mux        sync.Mutex
+	tty        bool
+	out        *json.Encoder
+	start      time.Time
+	last       time.Time
+	bytes      int64
+	totalBytes int64
+	files      int
+	totalFiles int
+}
+
+// newProgress returns nil if there is nowhere to report.
+func newProgress() *progress {
+	p := &progress{start: time.Now()}
+	if fi, err := os.Stderr.Stat(); err == nil && !flagVerbose {
+		p.tty = fi.Mode()&os.ModeCharDevice != 0
+	}
+	if flagProgressFd >= 0 {
+		fd := os.NewFile(uintptr(flagProgressFd), "progress")
+		if fd == nil {
+			fatal(fmt.Sprintf("bad progress fd: %d", flagProgressFd))
+		}
+		p.out = json.NewEncoder(fd)
+	}
+	if !p.tty && p.out == nil {
+		return nil
+	}
+	return p
+}
+
+func (p *progress) setTotal(bytes int64, files int) {
+	if p == nil {
+		return
+	}
+	p.mux.Lock()
+	p.totalBytes, p.totalFiles = bytes, files
+	p.mux.Unlock()
+}
+
+func (p *progress) addBytes(n int64) {
+	if p == nil {
+		return
+	}
+	p.mux.Lock()
+	p.bytes += n
+	p.report(false)
+	p.mux.Unlock()
+}
+
+func (p *progress) addFile() {
+	if p == nil {
+		return
+	}
+	p.mux.Lock()
+	p.files++
+	p.report(false)
+	p.mux.Unlock()
+}
+
+// finish prints the final report.
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	p.mux.Lock()
+	p.report(true)
+	if p.tty {
+		fmt.Fprintln(os.Stderr)
+	}
+	p.mux.Unlock()
+}
+
+type progressReport struct {
+	Bytes      int64   `json:"bytes"`
+	TotalBytes int64   `json:"total_bytes"`
+	Files      int     `json:"files"`
+	TotalFiles int     `json:"total_files"`
+	Rate       float64 `json:"rate"` // bytes per second
+	ETA        float64 `json:"eta"`  // seconds, or -1 if unknown
+	Done       bool    `json:"done"`
+}
+
+func (p *progress) report(done bool) {
+	now := time.Now()
+	if !done && now.Sub(p.last) < progressInterval {
+		return
+	}
+	p.last = now
+
+	r := progressReport{
+		Bytes:      p.bytes,
+		TotalBytes: p.totalBytes,
+		Files:      p.files,
+		TotalFiles: p.totalFiles,
+		ETA:        -1,
+		Done:       done,
+	}
+	if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+		r.Rate = float64(p.bytes) / elapsed
+	}
+	if done {
+		r.ETA = 0
+	} else if r.Rate > 0 && p.totalBytes >= p.bytes {
+		r.ETA = float64(p.totalBytes-p.bytes) / r.Rate
+	}
+
+	if p.out != nil {
+		p.out.Encode(&r)
+	}
+	if p.tty {
+		eta := "--:--"
+		if r.ETA >= 0 {
+			s := int(r.ETA)
+			eta = fmt.Sprintf("%02d:%02d", s/60, s%60)
+		}
+		fmt.Fprintf(os.Stderr, "\r%s / %s  %d/%d files  %.1f MB/s  ETA %s\x1b[K",
+			formatSize(r.Bytes), formatSize(r.TotalBytes), r.Files, r.TotalFiles,
+			r.Rate/1e6, eta)
+	}
+}
+
+// formatSize formats n in bytes with a binary unit.
+func formatSize(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	f := float64(n) / 1024
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", f, units[i])
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	ctr "github.com/lshpku/quicktar"
+)
+
+// selector selects files in the archive by the member names, globs or
+// regexps given as standalone arguments. A directory selects everything
+// under it.
+type selector struct {
+	patterns []string
+	regexps  []*regexp.Regexp
+	used     []bool
+
+	// parents contains directories of selected files.
+	parents map[string]bool
+}
+
+func newSelector(files []*ctr.File) *selector {
+	s := &selector{
+		patterns: flagFiles,
+		used:     make([]bool, len(flagFiles)),
+		parents:  map[string]bool{},
+	}
+	for _, p := range flagFiles {
+		if flagRegex {
+			re, err := regexp.Compile(p)
+			nilOrFatal(err)
+			s.regexps = append(s.regexps, re)
+		} else if _, err := path.Match(p, ""); err != nil {
+			fatal("bad pattern: " + p)
+		}
+	}
+	for _, f := range files {
+		if s.match(f.Name) {
+			for _, p := range ctr.Parents(f.Name) {
+				s.parents[p] = true
+			}
+		}
+	}
+	return s
+}
+
+// match reports whether name or any of its parents matches a pattern.
+func (s *selector) match(name string) bool {
+	if len(s.patterns) == 0 {
+		return true
+	}
+	matched := false
+	for i, p := range s.patterns {
+		for _, n := range append(ctr.Parents(name), name) {
+			var ok bool
+			if flagRegex {
+				ok = s.regexps[i].MatchString(n)
+			} else {
+				ok, _ = path.Match(strings.TrimSuffix(p, "/"), n)
+			}
+			if ok {
+				s.used[i] = true
+				matched = true
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// selected reports whether f should be processed, including directories
+// needed by selected files.
+func (s *selector) selected(f *ctr.File) bool {
+	return s.match(f.Name) || (f.IsDir() && s.parents[f.Name])
+}
+
+// warnUnused warns about patterns that match nothing and exits with error.
+func (s *selector) warnUnused() {
+	ok := true
+	for i, p := range s.patterns {
+		if !s.used[i] {
+			fmt.Fprintf(os.Stderr, "warning: %s: not found in archive\n", p)
+			ok = false
+		}
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
+	"runtime"
+	"sync"
 )
 
 const (
@@ -69,10 +71,14 @@ func NewCipher(enc int, pwd []byte) Cipher {
 	return newCipher(enc, pwd, nil)
 }
 
-func (c *Cipher) xorKeyStream(dst, src []byte, off int64) {
-	if c.block == nil {
-		return
-	}
+// parallelMinSize is the minimum length for xorKeyStreamParallel to split
+// the work across goroutines. Benchmarks raise it to measure the serial
+// path.
+var parallelMinSize = 256 << 10
+
+// newStream returns the keystream starting at off, which may be unaligned.
+// The cipher must not be Store.
+func (c *Cipher) newStream(off int64) cipher.Stream {
 	iv := make([]byte, 16)
 	bn := uint64(off / 16)
 	ivh := c.nonce[0]
@@ -83,5 +89,43 @@ func (c *Cipher) xorKeyStream(dst, src []byte, off int64) {
 	binary.BigEndian.PutUint64(iv[:8], ivh)
 	binary.BigEndian.PutUint64(iv[8:], ivl)
 	ctr := cipher.NewCTR(c.block, iv)
-	ctr.XORKeyStream(dst, src)
+	if skip := off % 16; skip != 0 {
+		buf := make([]byte, skip)
+		ctr.XORKeyStream(buf, buf)
+	}
+	return ctr
+}
+
+func (c *Cipher) xorKeyStream(dst, src []byte, off int64) {
+	if c.block == nil {
+		return
+	}
+	c.newStream(off).XORKeyStream(dst, src)
+}
+
+// xorKeyStreamParallel is like xorKeyStream but splits large inputs into
+// chunks and processes them on all CPUs. The output is the same.
+func (c *Cipher) xorKeyStreamParallel(dst, src []byte, off int64) {
+	if c.block == nil {
+		return
+	}
+	n := runtime.GOMAXPROCS(0)
+	if n == 1 || len(src) < parallelMinSize {
+		c.xorKeyStream(dst, src, off)
+		return
+	}
+	chunk := (len(src)/n + 15) / 16 * 16
+	var wg sync.WaitGroup
+	for s := 0; s < len(src); s += chunk {
+		e := s + chunk
+		if e > len(src) {
+			e = len(src)
+		}
+		wg.Add(1)
+		go func(s, e int) {
+			defer wg.Done()
+			c.xorKeyStream(dst[s:e], src[s:e], off+int64(s))
+		}(s, e)
+	}
+	wg.Wait()
 }
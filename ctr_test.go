@@ -0,0 +1,51 @@
+package quicktar
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestXorKeyStreamParallel(t *testing.T) {
+	c := NewCipherNonce(EncAES256, []byte("password"), nil)
+	src := make([]byte, 3*parallelMinSize+45)
+	rand.New(rand.NewSource(1)).Read(src)
+
+	for _, off := range []int64{0, 1, 15, 16, 17, 4097, 1<<32 + 7} {
+		for _, n := range []int{0, 1, 15, parallelMinSize - 1, parallelMinSize + 3, len(src)} {
+			want := make([]byte, n)
+			got := make([]byte, n)
+			c.xorKeyStream(want, src[:n], off)
+			c.xorKeyStreamParallel(got, src[:n], off)
+			if !bytes.Equal(got, want) {
+				t.Fatalf("off %d, size %d: parallel output differs", off, n)
+			}
+		}
+	}
+
+	// In place, as done by Writer.flush
+	want := make([]byte, len(src))
+	c.xorKeyStream(want, src, 13)
+	got := append([]byte(nil), src...)
+	c.xorKeyStreamParallel(got, got, 13)
+	if !bytes.Equal(got, want) {
+		t.Fatal("in-place parallel output differs")
+	}
+}
+
+func TestNewStreamOverflow(t *testing.T) {
+	// The low word of the counter wraps into the high word
+	c := NewCipherNonce(EncAES128, []byte("password"), []byte{
+		0, 0, 0, 0, 0, 0, 0, 1,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe,
+	})
+	want := make([]byte, 64)
+	c.xorKeyStream(want, want, 0)
+	for off := int64(1); off < 64; off++ {
+		got := make([]byte, 64-off)
+		c.xorKeyStream(got, got, off)
+		if !bytes.Equal(got, want[off:]) {
+			t.Fatalf("off %d: keystream differs", off)
+		}
+	}
+}
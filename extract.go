@@ -0,0 +1,627 @@
+package quicktar
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrInsecurePath is returned by Extract when a file would be written
+// outside the target directory, e.g. through a symlink in the archive.
+var ErrInsecurePath = errors.New("insecure path")
+
+// OverwritePolicy tells Extract what to do with existing files.
+// Existing directories are always merged into.
+type OverwritePolicy int
+
+const (
+	OverwriteReplace   OverwritePolicy = iota // replace existing files
+	OverwriteSkip                             // keep existing files
+	OverwriteError                            // fail with fs.ErrExist
+	OverwriteKeepNewer                        // keep files not older than in the archive
+	OverwriteBackup                           // rename existing files with suffix "~"
+)
+
+// ExtractAction is what Extract does to the path of a file.
+type ExtractAction int
+
+const (
+	ActionCreate  ExtractAction = iota // the path doesn't exist
+	ActionReplace                      // the existing file is removed
+	ActionBackup                       // the existing file is renamed
+	ActionSkip                         // the existing file is kept
+	ActionMerge                        // the existing directory is kept
+)
+
+func (a ExtractAction) String() string {
+	switch a {
+	case ActionCreate:
+		return "create"
+	case ActionReplace:
+		return "replace"
+	case ActionBackup:
+		return "backup"
+	case ActionSkip:
+		return "skip"
+	case ActionMerge:
+		return "merge"
+	}
+	return "unknown"
+}
+
+// ExtractOptions configures Extract. The zero value extracts everything,
+// replaces existing files and restores modes and modified times.
+type ExtractOptions struct {
+	// Filter reports whether to extract a file. Parent directories of
+	// extracted files are created even if they are filtered out.
+	Filter func(f *File) bool
+
+	// StripComponents removes that many leading levels from names, as
+	// StripComponents does. Files with no level left are skipped. Hooks
+	// get copies of File with the stripped names.
+	StripComponents int
+
+	Overwrite OverwritePolicy
+
+	// If DryRun is true, nothing is written. Files are still checked
+	// against the policy and reported to the hooks.
+	DryRun bool
+
+	// Workers is the number of regular files extracted concurrently.
+	// Values below 2 extract one file at a time. The metadata of a
+	// directory is still set after all its contents are done.
+	Workers int
+
+	// NoChmod leaves the modes of extracted files to the umask.
+	// NoChtimes leaves their modified times to now.
+	NoChmod   bool
+	NoChtimes bool
+
+	// If Chown is true, extracted files are owned by Uid and Gid.
+	// The archive doesn't store owners.
+	Chown    bool
+	Uid, Gid int
+
+	// Before is called before a file is extracted, and After is called
+	// with the result. Directories are reported when their metadata is
+	// set, i.e. after their contents. If Before returns an error, the
+	// extraction stops. If After returns nil, the error is ignored.
+	// Hooks are never called concurrently, even with Workers.
+	Before func(f *File, path string) error
+	After  func(f *File, path string, err error) error
+
+	// Plan is called with the action decided for a file, before it's
+	// taken. Actions are decided on the files existing before Extract,
+	// so directories created for their contents are reported as created.
+	Plan func(f *File, path string, action ExtractAction)
+
+	// DataProgress is called with the number of bytes of file data just
+	// written, about once per 1 MiB. With Workers, bytes written while
+	// it's running are added to the next call.
+	DataProgress func(n int64)
+}
+
+// Extract extracts the archive into the directory dst.
+//
+// Extract never follows symlinks under dst: a file whose parent is a
+// symlink fails with ErrInsecurePath, and an existing symlink at the path
+// of a file is replaced, skipped or reported as the policy says.
+//
+// These checks are made by path with os.Lstat before each file is
+// opened, so they only hold if nothing else writes to dst meanwhile: a
+// process that replaces a checked directory with a symlink in between
+// can still redirect a file outside dst.
+func (r *Reader) Extract(dst string, opts *ExtractOptions) error {
+	return r.ExtractContext(context.Background(), dst, opts)
+}
+
+// ExtractContext is like Extract, but stops with ctx.Err() if ctx is done
+// before a file is extracted.
+func (r *Reader) ExtractContext(ctx context.Context, dst string, opts *ExtractOptions) error {
+	files, err := r.allFiles()
+	if err != nil {
+		return err
+	}
+	e := &extractor{
+		r:         r,
+		ctx:       ctx,
+		dst:       dst,
+		dirExists: map[string]bool{},
+		created:   map[string]bool{},
+	}
+	if opts != nil {
+		e.opts = *opts
+	}
+	if e.opts.Filter != nil || e.opts.StripComponents > 0 {
+		selected := make([]*File, 0, len(files))
+		for _, f := range files {
+			if e.opts.Filter != nil && !e.opts.Filter(f) {
+				continue
+			}
+			if n := e.opts.StripComponents; n > 0 {
+				name := StripComponents(f.Name, n)
+				if name == "" {
+					continue
+				}
+				g := *f
+				g.Name = name
+				f = &g
+			}
+			selected = append(selected, f)
+		}
+		files = selected
+	}
+	if !e.opts.DryRun {
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			return err
+		}
+	}
+	return e.run(files)
+}
+
+type extractor struct {
+	r    *Reader
+	ctx  context.Context
+	dst  string
+	opts ExtractOptions
+
+	// mux guards the fields below, the hooks and the creation of
+	// parent directories when files are extracted by workers.
+	mux       sync.Mutex
+	dirExists map[string]bool
+	created   map[string]bool // directories created by createBasedir
+
+	jobs    chan *File
+	wg      sync.WaitGroup
+	cond    *sync.Cond
+	pending map[string]int // files being extracted at or under a path
+	err     error          // first error of workers
+
+	// written counts the bytes not yet reported to DataProgress. Workers
+	// add to it atomically, and the one holding progressMux reports it.
+	written     int64
+	progressMux sync.Mutex
+}
+
+func (e *extractor) run(files []*File) error {
+	if n := e.opts.Workers; n > 1 && !e.opts.DryRun {
+		e.jobs = make(chan *File, n)
+		e.cond = sync.NewCond(&e.mux)
+		e.pending = map[string]int{}
+		e.wg.Add(n)
+		for i := 0; i < n; i++ {
+			go e.worker()
+		}
+	}
+	err := e.runFiles(files)
+	if e.jobs != nil {
+		close(e.jobs)
+		e.wg.Wait()
+		if err == nil {
+			err = e.err
+		}
+	}
+	if e.opts.DataProgress != nil {
+		e.addWritten(0, true)
+	}
+	return err
+}
+
+func (e *extractor) runFiles(files []*File) error {
+	dirMap := map[string]*File{}
+	dirLastIdx := map[string]int{}
+
+	// Find the last indices of directories
+	for i, f := range files {
+		for _, p := range Parents(f.Name) {
+			dirLastIdx[p] = i
+		}
+		if f.IsDir() {
+			dirMap[f.Name] = f
+			dirLastIdx[f.Name] = i
+		}
+	}
+
+	for i, f := range files {
+		if err := e.ctx.Err(); err != nil {
+			return err
+		}
+		mode := f.Mode() & fs.ModeType
+
+		// 1. Regular file
+		if mode == 0 && e.jobs != nil {
+			if err := e.dispatch(f); err != nil {
+				return err
+			}
+		} else if mode == 0 {
+			if err := e.do(f, e.file); err != nil {
+				return err
+			}
+		}
+
+		// 2. Symlink, which may replace a directory being written into
+		if mode == fs.ModeSymlink {
+			if err := e.wait(""); err != nil {
+				return err
+			}
+			if err := e.do(f, e.symlink); err != nil {
+				return err
+			}
+		}
+
+		// 3. Empty directory
+		if f.IsDir() && dirLastIdx[f.Name] == i {
+			if err := e.wait(f.Name); err != nil {
+				return err
+			}
+			if err := e.do(f, e.emptyDir); err != nil {
+				return err
+			}
+		}
+
+		// 4. Parent directories
+		for _, p := range Parents(f.Name) {
+			if dirLastIdx[p] == i {
+				if df, ok := dirMap[p]; ok {
+					if err := e.wait(p); err != nil {
+						return err
+					}
+					if err := e.do(df, e.dir); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// dispatch sends a regular file to the workers. An earlier file with the
+// same name must be done first, since the later one replaces it.
+func (e *extractor) dispatch(f *File) error {
+	if err := e.wait(f.Name); err != nil {
+		return err
+	}
+	e.mux.Lock()
+	err := e.err
+	if err == nil {
+		e.pending[""]++
+		e.pending[f.Name]++
+		for _, p := range Parents(f.Name) {
+			e.pending[p]++
+		}
+	}
+	e.mux.Unlock()
+	if err != nil {
+		return err
+	}
+	e.jobs <- f
+	return nil
+}
+
+func (e *extractor) worker() {
+	defer e.wg.Done()
+	for f := range e.jobs {
+		e.mux.Lock()
+		failed := e.err != nil
+		e.mux.Unlock()
+
+		var err error
+		if !failed {
+			err = e.do(f, e.file)
+		}
+
+		e.mux.Lock()
+		if err != nil && e.err == nil {
+			e.err = err
+		}
+		e.pending[""]--
+		e.pending[f.Name]--
+		for _, p := range Parents(f.Name) {
+			e.pending[p]--
+		}
+		e.cond.Broadcast()
+		e.mux.Unlock()
+	}
+}
+
+// wait waits for the workers to finish the files at or under dir, where
+// "" stands for all files. It returns the first error of workers.
+func (e *extractor) wait(dir string) error {
+	if e.jobs == nil {
+		return nil
+	}
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	for e.pending[dir] > 0 && e.err == nil {
+		e.cond.Wait()
+	}
+	return e.err
+}
+
+// do calls fn on f with the hooks.
+func (e *extractor) do(f *File, fn func(f *File, path string) error) error {
+	path := e.path(f.Name)
+	if e.opts.Before != nil {
+		e.mux.Lock()
+		err := e.opts.Before(f, path)
+		e.mux.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	err := e.checkPath(f.Name)
+	if err == nil && e.opts.DryRun {
+		_, err = e.prepare(f, path)
+	} else if err == nil {
+		err = fn(f, path)
+	}
+	if e.opts.After != nil {
+		e.mux.Lock()
+		defer e.mux.Unlock()
+		return e.opts.After(f, path, err)
+	}
+	return err
+}
+
+func (e *extractor) path(name string) string {
+	return filepath.Join(e.dst, filepath.FromSlash(name))
+}
+
+// checkPath rejects names that are unsafe to join to dst. Names are
+// already checked by readMeta, but separators other than '/' are not.
+func (e *extractor) checkPath(name string) error {
+	if filepath.Separator != '/' && strings.ContainsAny(name, `\:`) {
+		return &fs.PathError{Op: "extract", Path: name, Err: ErrInsecurePath}
+	}
+	return nil
+}
+
+// createBasedir creates the parent directories of name. Unlike
+// os.MkdirAll, it refuses to go through symlinks.
+func (e *extractor) createBasedir(name string) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	for _, p := range Parents(name) {
+		if e.dirExists[p] {
+			continue
+		}
+		fi, err := os.Lstat(e.path(p))
+		if os.IsNotExist(err) {
+			err = os.Mkdir(e.path(p), 0755)
+			e.created[p] = true
+		} else if err == nil && !fi.IsDir() {
+			err = &fs.PathError{Op: "extract", Path: name, Err: ErrInsecurePath}
+		}
+		if err != nil {
+			return err
+		}
+		e.dirExists[p] = true
+	}
+	return nil
+}
+
+// action decides what to do with the path of f according to the
+// overwrite policy.
+func (e *extractor) action(f *File, path string) (ExtractAction, error) {
+	fi, err := os.Lstat(path)
+	e.mux.Lock()
+	created := e.created[f.Name]
+	e.mux.Unlock()
+	if os.IsNotExist(err) || (err == nil && created) {
+		return ActionCreate, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if f.IsDir() && fi.IsDir() {
+		return ActionMerge, nil
+	}
+	switch e.opts.Overwrite {
+	case OverwriteSkip:
+		return ActionSkip, nil
+	case OverwriteError:
+		return 0, &fs.PathError{Op: "extract", Path: path, Err: fs.ErrExist}
+	case OverwriteKeepNewer:
+		if !fi.ModTime().Before(f.ModTime()) {
+			return ActionSkip, nil
+		}
+	case OverwriteBackup:
+		return ActionBackup, nil
+	}
+	return ActionReplace, nil
+}
+
+// prepare decides and takes the action on the path of f, except for
+// writing the file. It returns false if the file should be skipped.
+func (e *extractor) prepare(f *File, path string) (bool, error) {
+	act, err := e.action(f, path)
+	if err != nil {
+		return false, err
+	}
+	if e.opts.Plan != nil {
+		e.mux.Lock()
+		e.opts.Plan(f, path, act)
+		e.mux.Unlock()
+	}
+	if e.opts.DryRun {
+		return false, nil
+	}
+	switch act {
+	case ActionSkip:
+		return false, nil
+	case ActionReplace:
+		err = os.Remove(path)
+	case ActionBackup:
+		err = os.Rename(path, path+"~")
+	}
+	if err != nil {
+		return false, err
+	}
+	if act != ActionCreate && act != ActionMerge {
+		// The file may be a directory that is known to exist
+		e.mux.Lock()
+		e.dirExists = map[string]bool{}
+		e.mux.Unlock()
+	}
+	return true, nil
+}
+
+func (e *extractor) file(f *File, path string) error {
+	if err := e.createBasedir(f.Name); err != nil {
+		return err
+	}
+	if ok, err := e.prepare(f, path); !ok || err != nil {
+		return err
+	}
+
+	perm := fs.FileMode(0600)
+	if e.opts.NoChmod {
+		perm = 0666
+	}
+	rf, err := e.r.Open(f)
+	if err != nil {
+		return err
+	}
+	defer rf.Close()
+	wf, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if err := e.copy(wf, rf); err != nil {
+		wf.Close()
+		return err
+	}
+
+	// Set file metadata
+	if !e.opts.NoChmod {
+		if err := wf.Chmod(f.Mode()); err != nil {
+			wf.Close()
+			return err
+		}
+	}
+	if err := wf.Close(); err != nil {
+		return err
+	}
+	return e.setMeta(f, path)
+}
+
+func (e *extractor) symlink(f *File, path string) error {
+	if err := e.createBasedir(f.Name); err != nil {
+		return err
+	}
+	if ok, err := e.prepare(f, path); !ok || err != nil {
+		return err
+	}
+	rf, err := e.r.Open(f)
+	if err != nil {
+		return err
+	}
+	defer rf.Close()
+	data, err := io.ReadAll(rf)
+	if err != nil {
+		return err
+	}
+	if err := os.Symlink(string(data), path); err != nil {
+		return err
+	}
+	// The symlink may replace a directory that is known to exist
+	e.mux.Lock()
+	e.dirExists = map[string]bool{}
+	e.mux.Unlock()
+	// Note: ignore mode or modTime for symlink
+	if e.opts.Chown {
+		return os.Lchown(path, e.opts.Uid, e.opts.Gid)
+	}
+	return nil
+}
+
+func (e *extractor) emptyDir(f *File, path string) error {
+	if err := e.createBasedir(f.Name); err != nil {
+		return err
+	}
+	if ok, err := e.prepare(f, path); !ok || err != nil {
+		return err
+	}
+	// Note: ignore 'file exists' error for existing directories.
+	if err := os.Mkdir(path, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	e.mux.Lock()
+	e.dirExists[f.Name] = true
+	e.mux.Unlock()
+	return e.setMeta(f, path)
+}
+
+// copy writes the content of rf to wf. With DataProgress, it's copied in
+// chunks, reporting after each, which still lets rf copy to wf directly.
+func (e *extractor) copy(wf *os.File, rf *FileDesc) error {
+	if e.opts.DataProgress == nil {
+		_, err := rf.WriteTo(wf)
+		return err
+	}
+	for {
+		n, err := rf.writeTo(wf, progressChunk)
+		e.addWritten(n, false)
+		if err != nil || n < progressChunk {
+			return err
+		}
+	}
+}
+
+// addWritten adds n to the bytes written and reports them. Unless wait
+// is true, it doesn't wait for another worker that is reporting, which
+// then leaves n to the next report.
+func (e *extractor) addWritten(n int64, wait bool) {
+	atomic.AddInt64(&e.written, n)
+	if wait {
+		e.progressMux.Lock()
+	} else if !e.progressMux.TryLock() {
+		return
+	}
+	if n := atomic.SwapInt64(&e.written, 0); n > 0 {
+		e.opts.DataProgress(n)
+	}
+	e.progressMux.Unlock()
+}
+
+// dir sets the metadata of a directory with contents.
+func (e *extractor) dir(f *File, path string) error {
+	if ok, err := e.prepare(f, path); !ok || err != nil {
+		return err
+	}
+	return e.setMeta(f, path)
+}
+
+// setMeta sets the mode, modified time and owner of a regular file or
+// directory. The mode of regular files is set before closing them.
+func (e *extractor) setMeta(f *File, path string) error {
+	// Make sure not to follow a symlink that replaced the directory
+	if f.IsDir() {
+		if fi, err := os.Lstat(path); err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return &fs.PathError{Op: "extract", Path: f.Name, Err: ErrInsecurePath}
+		}
+	}
+	if f.IsDir() && !e.opts.NoChmod {
+		if err := os.Chmod(path, f.Mode()); err != nil {
+			return err
+		}
+	}
+	if !e.opts.NoChtimes {
+		if err := os.Chtimes(path, f.ModTime(), f.ModTime()); err != nil {
+			return err
+		}
+	}
+	if e.opts.Chown {
+		return os.Lchown(path, e.opts.Uid, e.opts.Gid)
+	}
+	return nil
+}
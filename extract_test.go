@@ -0,0 +1,111 @@
+package quicktar
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExtractDuplicates(t *testing.T) {
+	// Older archives may have several files with one name, of which the
+	// last one is kept.
+	var files []testFile
+	for i := 0; i < 20; i++ {
+		files = append(files, testFile{"x", []byte(fmt.Sprint("content ", i))})
+		files = append(files, testFile{fmt.Sprint("d/f", i), []byte("f")})
+	}
+	name := filepath.Join(t.TempDir(), "test.qtar")
+	if err := os.WriteFile(name, legacyArchive(EncNone, files), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenReader(name, Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, workers := range []int{1, 8} {
+		for i := 0; i < 50; i++ {
+			dst := t.TempDir()
+			if err := r.Extract(dst, &ExtractOptions{Workers: workers}); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filepath.Join(dst, "x"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "content 19" {
+				t.Fatalf("%d workers: x has %q, want the last one", workers, data)
+			}
+		}
+	}
+}
+
+func TestExtractBadNames(t *testing.T) {
+	// Writer refuses such names, but older archives may have them
+	for _, bad := range []string{"../evil", "d/../../evil", "/evil", "d//evil"} {
+		name := filepath.Join(t.TempDir(), "test.qtar")
+		files := []testFile{{"d/a", []byte("a")}, {bad, []byte("evil")}}
+		if err := os.WriteFile(name, legacyArchive(EncNone, files), 0644); err != nil {
+			t.Fatal(err)
+		}
+		r, err := OpenReader(name, Store)
+		if err == nil {
+			r.Close()
+		}
+		if !errors.Is(err, ErrCorrupt) {
+			t.Errorf("name %q: got %v, want %v", bad, err, ErrCorrupt)
+		}
+	}
+}
+
+func TestExtractSymlinkEscape(t *testing.T) {
+	outside := t.TempDir()
+	name := filepath.Join(t.TempDir(), "test.qtar")
+	w, err := NewWriter(name, Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []struct {
+		name, data string
+		mode       fs.FileMode
+	}{
+		{"a", "a", 0644},
+		{"link", outside, fs.ModeSymlink | 0777},
+		{"link/evil", "evil", 0644},
+		{"b", "b", 0644},
+	} {
+		fw, err := w.CreateFile(f.name, f.mode, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write([]byte(f.data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := fw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenReader(name, Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, workers := range []int{1, 8} {
+		err := r.Extract(t.TempDir(), &ExtractOptions{Workers: workers})
+		if !errors.Is(err, ErrInsecurePath) {
+			t.Errorf("%d workers: got %v, want %v", workers, err, ErrInsecurePath)
+		}
+		if _, err := os.Lstat(filepath.Join(outside, "evil")); !os.IsNotExist(err) {
+			t.Fatalf("%d workers: file written outside: %v", workers, err)
+		}
+	}
+}
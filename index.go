@@ -0,0 +1,322 @@
+package quicktar
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// An indexed meta stores file headers in directory order (see dirCompare)
+// and appends an index after the file names:
+//
+//	nameOff  [pages]int64 // offset of the first name of each page,
+//	                      // relative to the start of names
+//	firstKey []string     // the first name of each page, '\0'-terminated
+//	padding               // to 32-byte alignment
+//	footer   struct {
+//	    magic     [8]byte // "QTIndex\0"
+//	    pageSize  int64   // number of files per page
+//	    namesSize int64   // size of the names, without padding
+//	    indexSize int64   // size of the index, including the footer
+//	}
+//
+// Readers unaware of the index ignore it, since it follows the names.
+// The footer is only taken as such if the names, padded to 32 bytes, and
+// the index fill the meta exactly, since the last file name could happen
+// to end with the magic.
+const (
+	indexMagic    = "QTIndex\x00"
+	indexPageSize = 1024
+
+	// indexCachePages is the number of pages kept in memory.
+	indexCachePages = 256
+
+	// maxIndexPageSize limits the page size read from an archive.
+	maxIndexPageSize = 1 << 20
+)
+
+// SetMetaIndex sets whether to write an index on Close, which allows the
+// archive to be opened by OpenReaderLazy. The files are then stored in
+// directory order rather than in the order they are created.
+//
+// Appending to an indexed archive keeps the index by default.
+func (w *Writer) SetMetaIndex(enable bool) {
+	w.indexed = enable
+}
+
+func (w *Writer) writeIndex(nameOff []int64, namesSize int64) error {
+	if err := w.padTo32(); err != nil {
+		return err
+	}
+	indexStart := w.getPos()
+	buf := make([]byte, 32)
+
+	for _, off := range nameOff {
+		binary.LittleEndian.PutUint64(buf, uint64(off))
+		if _, err := w.write(buf[:8]); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < len(w.file); i += indexPageSize {
+		key := append([]byte(w.file[i].name), 0)
+		if _, err := w.write(key); err != nil {
+			return err
+		}
+	}
+	if err := w.padTo32(); err != nil {
+		return err
+	}
+
+	copy(buf, indexMagic)
+	binary.LittleEndian.PutUint64(buf[8:], indexPageSize)
+	binary.LittleEndian.PutUint64(buf[16:], uint64(namesSize))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(w.getPos()+32-indexStart))
+	_, err := w.write(buf)
+	return err
+}
+
+// metaIndex locates files in an indexed meta without reading all of it.
+type metaIndex struct {
+	meta       metaInfo
+	pageSize   int
+	namesStart int64
+	nameOff    []int64 // with namesSize appended
+	firstKey   []string
+
+	mux   sync.Mutex
+	pages *lru[int, []*File]
+}
+
+// OpenReaderLazy is like OpenReader, but if the archive has an index
+// (see Writer.SetMetaIndex), only the index is read on open. The File
+// field is then nil, and files are loaded page by page on lookup.
+func OpenReaderLazy(name string, cipher Cipher) (*Reader, error) {
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := readTrailer(fd, &cipher)
+	if err == nil && !m.indexed {
+		fd.Close()
+		return OpenReader(name, cipher)
+	}
+	if err != nil {
+		fd.Close()
+		if err == ErrBadMagic {
+			return OpenReader(name, cipher)
+		}
+		return nil, err
+	}
+
+	index, err := readIndex(fd, &cipher, m)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	reader := &Reader{
+		Cipher: cipher,
+		fd:     fd,
+		meta:   m,
+		index:  index,
+	}
+	return reader, nil
+}
+
+func readIndex(fd *os.File, cipher *Cipher, m metaInfo) (*metaIndex, error) {
+	// Read footer
+	buf := make([]byte, 32)
+	if err := readFull(fd, buf, m.end-64); err != nil {
+		return nil, err
+	}
+	cipher.xorKeyStream(buf, buf, m.end-64)
+	pageSize := binary.LittleEndian.Uint64(buf[8:])
+	namesSize := binary.LittleEndian.Uint64(buf[16:])
+	indexSize := binary.LittleEndian.Uint64(buf[24:])
+
+	// Check sizes against the meta before using them
+	namesStart := m.start + int64(m.count)*32
+	space := uint64(m.end - 32 - namesStart)
+	if pageSize == 0 || pageSize > maxIndexPageSize {
+		return nil, fmt.Errorf("%w: index page size %d", ErrCorrupt, pageSize)
+	}
+	npages := uint64(m.count) / pageSize
+	if uint64(m.count)%pageSize != 0 {
+		npages++
+	}
+	if indexSize < 32+npages*8 || indexSize > space || namesSize > space-indexSize {
+		return nil, fmt.Errorf("%w: index size %d, names size %d", ErrCorrupt, indexSize, namesSize)
+	}
+	x := &metaIndex{
+		meta:       m,
+		pageSize:   int(pageSize),
+		namesStart: namesStart,
+		pages:      newLRU[int, []*File](indexCachePages),
+	}
+	indexStart := m.end - 32 - int64(indexSize)
+
+	// Read page table
+	buf = make([]byte, indexSize-32)
+	if err := readFull(fd, buf, indexStart); err != nil {
+		return nil, err
+	}
+	cipher.xorKeyStream(buf, buf, indexStart)
+	prev := uint64(0)
+	for i := uint64(0); i < npages; i++ {
+		off := binary.LittleEndian.Uint64(buf)
+		if off < prev || off > namesSize || (i == 0 && off != 0) {
+			return nil, fmt.Errorf("%w: index name offset %d", ErrCorrupt, off)
+		}
+		x.nameOff = append(x.nameOff, int64(off))
+		buf = buf[8:]
+		prev = off
+	}
+	x.nameOff = append(x.nameOff, int64(namesSize))
+	for i := uint64(0); i < npages; i++ {
+		j := 0
+		for j < len(buf) && buf[j] != 0 {
+			j++
+		}
+		if j == len(buf) {
+			return nil, fmt.Errorf("%w: unterminated index key", ErrCorrupt)
+		}
+		x.firstKey = append(x.firstKey, string(buf[:j]))
+		buf = buf[j+1:]
+	}
+	return x, nil
+}
+
+// page returns the files of page p, reading them if not cached.
+func (r *Reader) page(p int) ([]*File, error) {
+	x := r.index
+	x.mux.Lock()
+	files, ok := x.pages.get(p)
+	x.mux.Unlock()
+	if ok {
+		return files, nil
+	}
+
+	first := p * x.pageSize
+	count := x.meta.count - first
+	if count > x.pageSize {
+		count = x.pageSize
+	}
+	headOff := x.meta.start + int64(first)*32
+	nameOff := x.namesStart + x.nameOff[p]
+	buf := make([]byte, int64(count)*32+x.nameOff[p+1]-x.nameOff[p])
+	if _, err := r.pread(buf[:count*32], headOff); err != nil {
+		return nil, err
+	}
+	if _, err := r.pread(buf[count*32:], nameOff); err != nil {
+		return nil, err
+	}
+	r.xorKeyStream(buf[:count*32], buf[:count*32], headOff)
+	r.xorKeyStream(buf[count*32:], buf[count*32:], nameOff)
+
+	files, err := parseMeta(buf, count)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		f.reader = r
+	}
+	x.mux.Lock()
+	x.pages.add(p, files, 1)
+	x.mux.Unlock()
+	return files, nil
+}
+
+// lookupIndex finds the file with the given name by binary search.
+// It returns nil if not found.
+func (r *Reader) lookupIndex(name string) (*File, error) {
+	x := r.index
+	p := sort.Search(len(x.firstKey), func(i int) bool {
+		return dirCompare(x.firstKey[i], name) > 0
+	}) - 1
+	if p < 0 {
+		return nil, nil
+	}
+	files, err := r.page(p)
+	if err != nil {
+		return nil, err
+	}
+	i := sort.Search(len(files), func(i int) bool {
+		return dirCompare(files[i].Name, name) >= 0
+	})
+	if i < len(files) && files[i].Name == name {
+		return files[i], nil
+	}
+	return nil, nil
+}
+
+// scanIndex calls fn on each file from the first one whose parent
+// directory is not less than from, until fn returns false.
+func (r *Reader) scanIndex(from string, fn func(f *File) bool) error {
+	x := r.index
+	before := func(name string) bool {
+		d, _ := splitDir(name)
+		return d < from
+	}
+	p := sort.Search(len(x.firstKey), func(i int) bool {
+		return !before(x.firstKey[i])
+	}) - 1
+	if p < 0 {
+		p = 0
+	}
+
+	for ; p < len(x.firstKey); p++ {
+		files, err := r.page(p)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if !before(f.Name) && !fn(f) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// seekIndex returns the first file whose parent directory is not less
+// than from, or nil if there is none.
+func (r *Reader) seekIndex(from string) (*File, error) {
+	var found *File
+	err := r.scanIndex(from, func(f *File) bool {
+		found = f
+		return false
+	})
+	return found, err
+}
+
+// readDirIndex lists the files directly under dir ("" for root).
+// Implicit directories are not included.
+func (r *Reader) readDirIndex(dir string) ([]*File, error) {
+	list := make([]*File, 0)
+	err := r.scanIndex(dir, func(f *File) bool {
+		if d, _ := splitDir(f.Name); d != dir {
+			return false
+		}
+		list = append(list, f)
+		return true
+	})
+	return list, err
+}
+
+// allFiles returns File, or all files in the index for lazy readers.
+func (r *Reader) allFiles() ([]*File, error) {
+	if r.index == nil {
+		return r.File, nil
+	}
+	files := make([]*File, 0, r.index.meta.count)
+	for p := range r.index.firstKey {
+		page, err := r.page(p)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, page...)
+	}
+	return files, nil
+}
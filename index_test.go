@@ -0,0 +1,55 @@
+package quicktar
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIndexMagicInName(t *testing.T) {
+	// The last names end with the magic at the block before the trailer,
+	// with zeros after it.
+	for _, last := range []string{indexMagic[:7], strings.Repeat("a", 32) + indexMagic[:7]} {
+		name := filepath.Join(t.TempDir(), "test.qtar")
+		writeArchive(t, name, Store, false, testFile{last, []byte("data")})
+
+		r, err := OpenReaderLazy(name, Store)
+		if err != nil {
+			t.Fatalf("%q: %v", last, err)
+		}
+		if r.index != nil || len(r.File) != 1 || r.File[0].Name != last {
+			t.Fatalf("%q: taken as an indexed archive", last)
+		}
+		r.Close()
+
+		w, err := OpenWriter(name, Store)
+		if err != nil {
+			t.Fatalf("%q: %v", last, err)
+		}
+		if w.indexed {
+			t.Errorf("%q: appending would write an index", last)
+		}
+		w.Close()
+	}
+}
+
+func TestIndexLayout(t *testing.T) {
+	for _, n := range []int{0, 1, indexPageSize, indexPageSize + 1} {
+		files := make([]testFile, n)
+		for i := range files {
+			files[i] = testFile{fmt.Sprintf("d%d/f%0*d", i%3, i%40+1, i), nil}
+		}
+		name := filepath.Join(t.TempDir(), "test.qtar")
+		writeArchive(t, name, NewCipherNonce(EncAES128, []byte("pw"), nil), true, files...)
+
+		r, err := OpenReaderLazy(name, NewCipher(EncAES128, []byte("pw")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.index == nil {
+			t.Fatalf("%d files: index not found", n)
+		}
+		r.Close()
+	}
+}
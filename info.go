@@ -0,0 +1,42 @@
+package quicktar
+
+import "encoding/binary"
+
+// ArchiveInfo describes the layout of an archive. See README.md for the
+// format.
+type ArchiveInfo struct {
+	// Legacy is true if the archive is of the older format, which has no
+	// header and uses a fixed nonce.
+	Legacy    bool
+	Encrypted bool
+	Nonce     []byte // nil if not encrypted
+
+	DataStart int64 // start of the data region
+	MetaStart int64 // start of meta, i.e. end of the data region
+	MetaEnd   int64 // end of meta, i.e. end of the archive
+	Count     int   // number of files in meta
+	Indexed   bool  // whether meta has an index, see Writer.SetMetaIndex
+}
+
+// Info returns the layout of the archive.
+func (r *Reader) Info() ArchiveInfo {
+	m := r.meta
+	info := ArchiveInfo{
+		Legacy:    m.legacy,
+		Encrypted: r.block != nil,
+		DataStart: 32,
+		MetaStart: m.start,
+		MetaEnd:   m.end,
+		Count:     m.count,
+		Indexed:   m.indexed,
+	}
+	if m.legacy {
+		info.DataStart = 0
+	}
+	if r.block != nil {
+		info.Nonce = make([]byte, 16)
+		binary.BigEndian.PutUint64(info.Nonce, r.nonce[0])
+		binary.BigEndian.PutUint64(info.Nonce[8:], r.nonce[1])
+	}
+	return info
+}
@@ -0,0 +1,281 @@
+package quicktar
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var errNotDir = errors.New("not a directory")
+
+// dirTree maps names to files and directories to their children.
+// It is built on first use for readers opened without index.
+type dirTree struct {
+	once     sync.Once
+	files    map[string]*File
+	children map[string][]*File
+}
+
+func (r *Reader) buildTree() {
+	t := &r.tree
+	t.files = make(map[string]*File, len(r.File))
+	t.children = make(map[string][]*File)
+	add := func(f *File) {
+		t.files[f.Name] = f
+		dir, _ := splitDir(f.Name)
+		t.children[dir] = append(t.children[dir], f)
+	}
+	for _, f := range r.File {
+		if old, ok := t.files[f.Name]; ok {
+			// Replace the implicit directory or the duplicated name
+			dir, _ := splitDir(f.Name)
+			for i, c := range t.children[dir] {
+				if c == old {
+					t.children[dir][i] = f
+				}
+			}
+			t.files[f.Name] = f
+			continue
+		}
+		for _, p := range Parents(f.Name) {
+			if _, ok := t.files[p]; !ok {
+				add(r.implicitDir(p))
+			}
+		}
+		add(f)
+	}
+	for _, list := range t.children {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].name < list[j].name
+		})
+	}
+}
+
+// implicitDir returns a directory that isn't in the archive but has
+// descendants in it.
+func (r *Reader) implicitDir(name string) *File {
+	return &File{
+		fileHeader: fileHeader{
+			name: BaseName(name),
+			mode: fs.ModeDir | 0755,
+		},
+		Name:   name,
+		reader: r,
+	}
+}
+
+// Lookup returns the file with the given full name. Parent directories
+// that aren't stored in the archive are also found as implicit ones.
+func (r *Reader) Lookup(name string) (*File, error) {
+	f, err := r.lookup(name)
+	if err == nil && f == nil {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "lookup", Path: name, Err: err}
+	}
+	return f, nil
+}
+
+func (r *Reader) lookup(name string) (*File, error) {
+	if r.index == nil {
+		r.tree.once.Do(r.buildTree)
+		return r.tree.files[name], nil
+	}
+
+	f, err := r.lookupIndex(name)
+	if f != nil || err != nil {
+		return f, err
+	}
+
+	// Check for implicit directory. Note that "a-b" sorts between "a" and
+	// "a/b", so directory a and its subdirectories are checked separately.
+	prefix := name + "/"
+	for _, from := range []string{name, prefix} {
+		f, err = r.seekIndex(from)
+		if err != nil || f == nil {
+			return nil, err
+		}
+		if dir, _ := splitDir(f.Name); dir == name || strings.HasPrefix(dir, prefix) {
+			return r.implicitDir(name), nil
+		}
+	}
+	return nil, nil
+}
+
+// ReadDir returns the files directly under dir sorted by name, where ""
+// stands for the root. Implicit directories are included.
+func (r *Reader) ReadDir(dir string) ([]*File, error) {
+	if dir != "" {
+		f, err := r.lookup(dir)
+		if err == nil && f == nil {
+			err = fs.ErrNotExist
+		} else if err == nil && !f.IsDir() {
+			err = errNotDir
+		}
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: dir, Err: err}
+		}
+	}
+
+	if r.index == nil {
+		r.tree.once.Do(r.buildTree)
+		list := r.tree.children[dir]
+		return append(make([]*File, 0, len(list)), list...), nil
+	}
+
+	list, err := r.readDirIndex(dir)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: dir, Err: err}
+	}
+
+	// Find implicit subdirectories by skipping subtrees. Directories are
+	// visited in order, where a sibling like "a-b" sorts between "a" and
+	// the subtree "a/...".
+	prefix, from := dir+"/", dir+"/"
+	if dir == "" {
+		prefix, from = "", "\x00"
+	}
+	seen := make(map[string]bool, len(list))
+	for _, f := range list {
+		seen[f.Name] = true
+	}
+	for {
+		f, err := r.seekIndex(from)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: dir, Err: err}
+		}
+		if f == nil {
+			break
+		}
+		d, _ := splitDir(f.Name)
+		if !strings.HasPrefix(d, prefix) {
+			break
+		}
+		child := prefix + Split(d[len(prefix):])[0]
+		if !seen[child] {
+			seen[child] = true
+			list = append(list, r.implicitDir(child))
+		}
+		if d == child {
+			from = child + "\x00"
+		} else {
+			from = child + "0" // right after child + "/"
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].name < list[j].name
+	})
+	return list, nil
+}
+
+// WalkFunc is the type of the function called by Walk to visit each file.
+// If it returns fs.SkipDir on a directory, Walk skips its contents.
+type WalkFunc func(f *File, err error) error
+
+// Walk walks the file tree rooted at root in lexical order, calling fn for
+// each file or directory, including root. Use "" to walk the whole
+// archive, in which case fn isn't called for the root itself.
+func (r *Reader) Walk(root string, fn WalkFunc) error {
+	if root == "" {
+		err := r.walkDir("", fn)
+		if err == fs.SkipDir {
+			return nil
+		}
+		return err
+	}
+	f, err := r.Lookup(root)
+	if err != nil {
+		return fn(nil, err)
+	}
+	err = r.walk(f, fn)
+	if err == fs.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func (r *Reader) walk(f *File, fn WalkFunc) error {
+	err := fn(f, nil)
+	if err == fs.SkipDir && f.IsDir() {
+		return nil
+	}
+	if err != nil || !f.IsDir() {
+		return err
+	}
+	return r.walkDir(f.Name, fn)
+}
+
+// walkDir walks the contents of dir. If fn returns fs.SkipDir on a file,
+// the remaining files in dir are skipped.
+func (r *Reader) walkDir(dir string, fn WalkFunc) error {
+	list, err := r.ReadDir(dir)
+	if err != nil {
+		return fn(nil, err)
+	}
+	for _, f := range list {
+		if err := r.walk(f, fn); err != nil {
+			if err == fs.SkipDir {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Glob returns the files whose full names match pattern, as defined by
+// path.Match. Each level of pattern is matched against one level of
+// names. The only possible error is path.ErrBadPattern.
+func (r *Reader) Glob(pattern string) ([]*File, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	return r.glob("", Split(pattern))
+}
+
+func (r *Reader) glob(dir string, parts []string) ([]*File, error) {
+	join := func(name string) string {
+		if dir == "" {
+			return name
+		}
+		return dir + "/" + name
+	}
+
+	var list []*File
+	if !strings.ContainsAny(parts[0], `*?[\`) {
+		if f, _ := r.lookup(join(parts[0])); f != nil {
+			list = []*File{f}
+		}
+	} else {
+		all, err := r.ReadDir(dir)
+		if err != nil {
+			return nil, nil
+		}
+		for _, f := range all {
+			if ok, _ := path.Match(parts[0], f.name); ok {
+				list = append(list, f)
+			}
+		}
+	}
+	if len(parts) == 1 {
+		return list, nil
+	}
+
+	matches := make([]*File, 0)
+	for _, f := range list {
+		if !f.IsDir() {
+			continue
+		}
+		m, err := r.glob(f.Name, parts[1:])
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, m...)
+	}
+	return matches, nil
+}
@@ -0,0 +1,57 @@
+package quicktar
+
+import "container/list"
+
+// lru is a least-recently-used cache bounded by the total cost of items.
+// It is not safe for concurrent use.
+type lru[K comparable, V any] struct {
+	capacity int64
+	cost     int64
+	list     *list.List
+	items    map[K]*list.Element
+}
+
+type lruItem[K comparable, V any] struct {
+	key   K
+	value V
+	cost  int64
+}
+
+func newLRU[K comparable, V any](capacity int64) *lru[K, V] {
+	return &lru[K, V]{
+		capacity: capacity,
+		list:     list.New(),
+		items:    make(map[K]*list.Element),
+	}
+}
+
+func (c *lru[K, V]) get(key K) (value V, ok bool) {
+	e, ok := c.items[key]
+	if !ok {
+		return value, false
+	}
+	c.list.MoveToFront(e)
+	return e.Value.(*lruItem[K, V]).value, true
+}
+
+// add inserts or replaces an item, then evicts the least recently used
+// items until the total cost fits in capacity.
+func (c *lru[K, V]) add(key K, value V, cost int64) {
+	if e, ok := c.items[key]; ok {
+		item := e.Value.(*lruItem[K, V])
+		c.cost += cost - item.cost
+		item.value = value
+		item.cost = cost
+		c.list.MoveToFront(e)
+	} else {
+		c.items[key] = c.list.PushFront(&lruItem[K, V]{key, value, cost})
+		c.cost += cost
+	}
+	for c.cost > c.capacity && c.list.Len() > 0 {
+		e := c.list.Back()
+		item := e.Value.(*lruItem[K, V])
+		c.list.Remove(e)
+		delete(c.items, item.key)
+		c.cost -= item.cost
+	}
+}
@@ -1,5 +1,10 @@
 package quicktar
 
+import (
+	"errors"
+	"strings"
+)
+
 func BaseName(path string) string {
 	lastSlash := -1
 	for i, c := range path {
@@ -36,3 +41,56 @@ func Parents(path string) []string {
 	}
 	return list
 }
+
+// splitDir splits path into its parent directory and base name.
+// The parent of a top-level path is "".
+func splitDir(path string) (dir, base string) {
+	i := strings.LastIndexByte(path, '/')
+	if i < 0 {
+		return "", path
+	}
+	return path[:i], path[i+1:]
+}
+
+// dirCompare compares a and b in directory order, i.e. by parent directory
+// first and then by base name, so that entries of a directory are adjacent.
+func dirCompare(a, b string) int {
+	da, ba := splitDir(a)
+	db, bb := splitDir(b)
+	if c := strings.Compare(da, db); c != 0 {
+		return c
+	}
+	return strings.Compare(ba, bb)
+}
+
+// checkName checks that name follows the constraints of CreateFile.
+func checkName(name string) error {
+	if name == "" {
+		return errors.New("empty name")
+	}
+	if name[0] == '/' {
+		return errors.New("leading slash")
+	}
+	if name[len(name)-1] == '/' {
+		return errors.New("trailing slash")
+	}
+	for _, s := range Split(name) {
+		if s == "" || s == "." || s == ".." {
+			return errors.New("invalid level of directory: '" + s + "'")
+		}
+	}
+	return nil
+}
+
+// StripComponents removes the first n levels from path, like the option
+// of tar. It returns "" if path has no more than n levels.
+func StripComponents(path string, n int) string {
+	for ; n > 0; n-- {
+		i := strings.IndexByte(path, '/')
+		if i < 0 {
+			return ""
+		}
+		path = path[i+1:]
+	}
+	return path
+}
@@ -0,0 +1,146 @@
+package quicktar
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+)
+
+// prefetchSize is the size of data read ahead from each file. The rest
+// is read when the file is written.
+const prefetchSize = writeBufSize
+
+var errStopWalk = errors.New("stop walk")
+
+// addItem is a file visited by the walk, whose content may be read
+// ahead by a worker.
+type addItem struct {
+	p, name string
+	fi      fs.FileInfo
+	err     error // error of the walk
+
+	done    chan struct{} // closed when the read ahead is done
+	r       io.ReadCloser
+	data    []byte
+	openErr error
+}
+
+// fetch opens the file and reads its beginning.
+func (a *adder) fetch(it *addItem) {
+	defer close(it.done)
+	r, err := a.src.open(it.p)
+	if err != nil {
+		it.openErr = err
+		return
+	}
+	size := it.fi.Size()
+	if size > prefetchSize {
+		size = prefetchSize
+	}
+	buf := make([]byte, size)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil // the file was truncated
+	}
+	if err != nil {
+		r.Close()
+		it.openErr = err
+		return
+	}
+	it.r, it.data = r, buf[:n]
+}
+
+// open returns the content read ahead followed by the rest of the file.
+func (it *addItem) open(p string) (io.ReadCloser, error) {
+	<-it.done
+	if it.openErr != nil {
+		return nil, it.openErr
+	}
+	r := &prefetched{io.MultiReader(bytes.NewReader(it.data), it.r), it.r}
+	it.r, it.data = nil, nil
+	return r, nil
+}
+
+// discard waits for the read ahead and closes the file if it isn't
+// taken by open.
+func (it *addItem) discard() {
+	if it.done == nil {
+		return
+	}
+	<-it.done
+	if it.r != nil {
+		it.r.Close()
+	}
+}
+
+type prefetched struct {
+	io.Reader
+	io.Closer
+}
+
+// runPipeline walks in a separate goroutine, which starts reading ahead
+// regular files by at most Workers goroutines, while the files are added
+// in the order of the walk.
+func (a *adder) runPipeline(walk func(visit visitFunc) error) error {
+	n := a.opts.Workers
+	items := make(chan *addItem, n)
+	sem := make(chan struct{}, n)
+	stop := make(chan struct{})
+
+	walkErr := make(chan error, 1)
+	go func() {
+		err := walk(func(p, name string, fi fs.FileInfo, err error) error {
+			it := &addItem{p: p, name: name, fi: fi, err: err}
+			if err == nil {
+				if ok, err := a.filter(name, fi); !ok {
+					return err
+				}
+				if fi.Mode().IsRegular() {
+					select {
+					case sem <- struct{}{}:
+					case <-stop:
+						return errStopWalk
+					}
+					it.done = make(chan struct{})
+					go func() {
+						a.fetch(it)
+						<-sem
+					}()
+				}
+			}
+			select {
+			case items <- it:
+				return nil
+			case <-stop:
+				it.discard()
+				return errStopWalk
+			}
+		})
+		close(items)
+		walkErr <- err
+	}()
+
+	var err error
+	for it := range items {
+		if err != nil {
+			it.discard()
+			continue
+		}
+		if it.err != nil {
+			err = a.fail(it.name, it.err)
+		} else if it.done != nil {
+			err = a.add(it.p, it.name, it.fi, it.open)
+			it.discard()
+		} else {
+			err = a.add(it.p, it.name, it.fi, a.src.open)
+		}
+		if err != nil {
+			close(stop)
+		}
+	}
+	if werr := <-walkErr; err == nil && werr != errStopWalk {
+		err = werr
+	}
+	return err
+}
@@ -3,18 +3,33 @@ package quicktar
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"sync"
 	"time"
 )
 
 // Reader represents an open archive for read.
+//
+// All files opened from a Reader share a single fd and read it with
+// positional reads, so opening a file costs no syscall.
 type Reader struct {
 	Cipher
-	File    []*File
-	name    string
-	fdCache *fdCache
+	File []*File
+	fd   *os.File
+
+	// mux guards fd against being closed during reads.
+	mux    sync.RWMutex
+	closed bool
+	cache  *blockCache
+	meta   metaInfo
+
+	// index is set if the archive is opened by OpenReaderLazy.
+	// Otherwise, tree is built from File on demand.
+	index *metaIndex
+	tree  dirTree
 }
 
 // OpenReader opens the archive for read.
@@ -24,40 +39,106 @@ func OpenReader(name string, cipher Cipher) (*Reader, error) {
 		return nil, err
 	}
 
-	files, err := readMeta(fd, &cipher, nil)
+	var m metaInfo
+	files, err := readMeta(fd, &cipher, &m, true)
 	if err != nil {
 		fd.Close()
 		return nil, err
 	}
 
 	reader := &Reader{
-		Cipher:  cipher,
-		File:    files,
-		name:    name,
-		fdCache: newFdCache(fd),
+		Cipher: cipher,
+		File:   files,
+		fd:     fd,
+		meta:   m,
+	}
+	for _, f := range files {
+		f.reader = reader
 	}
 	return reader, nil
 }
 
-// readMeta reads the meta part of fd.
-// metaOff is the offset of meta, where you can append from.
+// metaInfo describes where the meta part of an archive is.
+type metaInfo struct {
+	start   int64 // offset of meta, where you can append from
+	end     int64
+	count   int
+	indexed bool // whether meta ends with an index, see index.go
+	legacy  bool // whether it's the older format without header
+}
+
+// Errors of opening an archive. The returned errors may wrap them with
+// details, so use errors.Is to check for them.
+var (
+	ErrBadMagic      = errors.New("bad magic")
+	ErrWrongPassword = errors.New("wrong password")
+	ErrCorrupt       = errors.New("corrupt archive")
+	ErrTruncated     = errors.New("truncated archive")
+)
+
+// readFull reads len(buf) bytes at off of fd, failing with ErrTruncated
+// if fd is too short.
+func readFull(fd *os.File, buf []byte, off int64) error {
+	_, err := fd.ReadAt(buf, off)
+	if err == io.EOF {
+		return ErrTruncated
+	}
+	return err
+}
+
+// readMeta reads the meta part of fd and fills info. Sizes read from fd
+// are checked against the size of fd before allocating anything.
+// If legacy is true, the older format is read as a fallback.
 // The nonce in cipher will be updated.
-func readMeta(fd *os.File, cipher *Cipher, metaOff *int64) ([]*File, error) {
+func readMeta(fd *os.File, cipher *Cipher, info *metaInfo, legacy bool) ([]*File, error) {
+	m, err := readTrailer(fd, cipher)
+	if err == ErrBadMagic && legacy {
+		// Deprecated, read-only
+		println("warning: bad magic, fallback to older format")
+		cipher.nonce = []uint64{binary.BigEndian.Uint64(deprecatedNonce), 0}
+		return readHeader(fd, *cipher, info)
+	}
+	if err != nil {
+		return nil, err
+	}
+	*info = m
+
+	// Read file metadata
+	buf := make([]byte, m.end-32-m.start)
+	if err := readFull(fd, buf, m.start); err != nil {
+		return nil, err
+	}
+	cipher.xorKeyStream(buf, buf, m.start)
+	return parseMeta(buf, m.count)
+}
+
+// readTrailer reads the header and the final block of meta.
+// The nonce in cipher will be updated.
+func readTrailer(fd *os.File, cipher *Cipher) (metaInfo, error) {
+	var m metaInfo
+
 	// Read header
 	buf := make([]byte, 32)
-	if _, err := fd.Read(buf); err != nil {
-		return nil, err
+	if err := readFull(fd, buf, 0); err == ErrTruncated {
+		return m, ErrBadMagic
+	} else if err != nil {
+		return m, err
 	}
 	if string(buf[:8]) != "QuickTar" {
-		if metaOff != nil {
-			return nil, errors.New("bad magic")
-		}
-		// Deprecated, read-only
-		println("warning: bad magic, fallback to older format")
-		cipher.nonce = []uint64{binary.BigEndian.Uint64(deprecatedNonce), 0}
-		return readHeader(fd, *cipher, nil)
+		return m, ErrBadMagic
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		return m, err
 	}
-	metaEnd := int64(binary.LittleEndian.Uint64(buf[8:]))
+	end := binary.LittleEndian.Uint64(buf[8:])
+	if end < 64 {
+		return m, fmt.Errorf("%w: meta end %d", ErrCorrupt, end)
+	}
+	if end > uint64(fi.Size()) {
+		return m, fmt.Errorf("%w: meta ends at %d of %d bytes", ErrTruncated, end, fi.Size())
+	}
+	m.end = int64(end)
 	if cipher.block != nil {
 		cipher.nonce = []uint64{
 			binary.BigEndian.Uint64(buf[16:]),
@@ -66,26 +147,47 @@ func readMeta(fd *os.File, cipher *Cipher, metaOff *int64) ([]*File, error) {
 	}
 
 	// Read the final block
-	if _, err := fd.ReadAt(buf, metaEnd-32); err != nil {
-		return nil, err
+	if err := readFull(fd, buf, m.end-32); err != nil {
+		return m, err
 	}
-	cipher.xorKeyStream(buf, buf, metaEnd-32)
+	cipher.xorKeyStream(buf, buf, m.end-32)
 	if binary.LittleEndian.Uint64(buf[24:]) != 0 {
-		return nil, errors.New("wrong password")
+		return m, ErrWrongPassword
+	}
+	size := binary.LittleEndian.Uint64(buf)
+	count := binary.LittleEndian.Uint64(buf[8:])
+	if size < 32 || size > uint64(m.end-32) {
+		return m, fmt.Errorf("%w: meta size %d", ErrCorrupt, size)
 	}
-	metaSize := int64(binary.LittleEndian.Uint64(buf))
-	count := int(binary.LittleEndian.Uint64(buf[8:]))
-	metaStart := metaEnd - metaSize
-	if metaOff != nil {
-		*metaOff = metaStart
+	if count > (size-32)/32 {
+		return m, fmt.Errorf("%w: %d files in %d bytes of meta", ErrCorrupt, count, size)
 	}
+	m.start = m.end - int64(size)
+	m.count = int(count)
+
+	// Check the index footer. The last names may look like the magic, so
+	// the sizes in it must also match the layout exactly.
+	if m.end-m.start >= 64 {
+		if err := readFull(fd, buf, m.end-64); err != nil {
+			return m, err
+		}
+		cipher.xorKeyStream(buf, buf, m.end-64)
+		namesSize := binary.LittleEndian.Uint64(buf[16:])
+		indexSize := binary.LittleEndian.Uint64(buf[24:])
+		space := uint64(size-32) - count*32
+		m.indexed = string(buf[:8]) == indexMagic &&
+			indexSize >= 32 && indexSize%32 == 0 && indexSize <= space &&
+			namesSize <= space && (namesSize+31)/32*32 == space-indexSize
+	}
+	return m, nil
+}
 
-	// Read file metadata
-	buf = make([]byte, metaSize-32)
-	if _, err := fd.ReadAt(buf, metaStart); err != nil {
-		return nil, err
+// parseMeta parses count file headers followed by their names.
+// Anything after the names is ignored.
+func parseMeta(buf []byte, count int) ([]*File, error) {
+	if count < 0 || count > len(buf)/32 {
+		return nil, fmt.Errorf("%w: %d files in %d bytes of meta", ErrCorrupt, count, len(buf))
 	}
-	cipher.xorKeyStream(buf, buf, metaStart)
 	files := make([]*File, count)
 	for i := 0; i < count; i++ {
 		offset := binary.LittleEndian.Uint64(buf)
@@ -105,109 +207,114 @@ func readMeta(fd *os.File, cipher *Cipher, metaOff *int64) ([]*File, error) {
 	}
 
 	// Read file names
-	for i := 0; i < count && len(buf) > 0; i++ {
+	for i := 0; i < count; i++ {
+		if len(buf) == 0 {
+			return nil, fmt.Errorf("%w: %d of %d file names missing", ErrCorrupt, count-i, count)
+		}
 		j := 0
 		for j < len(buf) && buf[j] != 0 {
 			j++
 		}
 		if j == len(buf) {
-			return nil, errors.New("missing file names")
+			return nil, fmt.Errorf("%w: unterminated file name", ErrCorrupt)
 		}
 		files[i].Name = string(buf[:j])
 		files[i].fileHeader.name = BaseName(files[i].Name)
+		if err := checkName(files[i].Name); err != nil {
+			return nil, fmt.Errorf("%w: bad file name %q: %v", ErrCorrupt, files[i].Name, err)
+		}
 		buf = buf[j+1:]
 	}
 
 	return files, nil
 }
 
-func readHeader(fd *os.File, cipher Cipher, metaOff *int64) ([]*File, error) {
+func readHeader(fd *os.File, cipher Cipher, info *metaInfo) ([]*File, error) {
 	// Read last block
 	fi, err := fd.Stat()
 	if err != nil {
 		return nil, err
 	}
 	size := fi.Size()
+	if size < 32 {
+		return nil, ErrTruncated
+	}
 
 	buf := make([]byte, 32)
-	_, err = fd.ReadAt(buf, size-32)
-	if err != nil && err != io.EOF {
+	if err := readFull(fd, buf, size-32); err != nil {
 		return nil, err
 	}
 	cipher.xorKeyStream(buf, buf, size-32)
 	if binary.LittleEndian.Uint64(buf[24:]) != 0 {
-		return nil, errors.New("reserved fields should be zero")
+		return nil, ErrWrongPassword
 	}
 
-	off := int64(binary.LittleEndian.Uint64(buf))
-	count := int(binary.LittleEndian.Uint64(buf[8:]))
-	if metaOff != nil {
-		*metaOff = off
+	uoff := binary.LittleEndian.Uint64(buf)
+	ucount := binary.LittleEndian.Uint64(buf[8:])
+	if uoff > uint64(size-32) {
+		return nil, fmt.Errorf("%w: meta offset %d", ErrCorrupt, uoff)
 	}
+	if ucount > (uint64(size-32)-uoff)/32 {
+		return nil, fmt.Errorf("%w: %d files in %d bytes of meta", ErrCorrupt, ucount, uint64(size)-uoff)
+	}
+	off, count := int64(uoff), int(ucount)
+
+	*info = metaInfo{start: off, end: size, count: count, legacy: true}
 
-	// Read file headers except names
+	// Read file headers and names
 	buf = make([]byte, size-32-off)
-	_, err = fd.ReadAt(buf, off)
-	if err != nil {
+	if err := readFull(fd, buf, off); err != nil {
 		return nil, err
 	}
 	cipher.xorKeyStream(buf, buf, off)
-
-	files := make([]*File, count)
-	for i := 0; i < count; i++ {
-		offset := binary.LittleEndian.Uint64(buf)
-		size := binary.LittleEndian.Uint64(buf[8:])
-		mode := binary.LittleEndian.Uint32(buf[16:])
-		nsec := binary.LittleEndian.Uint32(buf[20:])
-		sec := binary.LittleEndian.Uint64(buf[24:])
-		files[i] = &File{
-			fileHeader: fileHeader{
-				offset:  int64(offset),
-				size:    int64(size),
-				mode:    fs.FileMode(mode),
-				modTime: time.Unix(int64(sec), int64(nsec)),
-			},
-		}
-		buf = buf[32:]
-	}
-
-	// Read file names
-	for i := 0; i < count && len(buf) > 0; i++ {
-		j := 0
-		for j < len(buf) && buf[j] != 0 {
-			j++
-		}
-		if j == len(buf) {
-			return nil, errors.New("missing file names")
-		}
-		files[i].Name = string(buf[:j])
-		files[i].fileHeader.name = BaseName(files[i].Name)
-		buf = buf[j+1:]
-	}
-
-	return files, nil
+	return parseMeta(buf, count)
 }
 
 // Open opens the file for reading.
 //
-// User may open multiple files concurrently. If so, each file has its own fd.
+// User may open multiple files concurrently.
 func (r *Reader) Open(f *File) (*FileDesc, error) {
-	fd := r.fdCache.acquire()
-	if fd == nil {
-		var err error
-		fd, err = os.Open(r.name)
-		if err != nil {
-			return nil, err
-		}
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	if r.closed {
+		return nil, fs.ErrClosed
 	}
 	return &FileDesc{
 		reader: r,
-		fd:     fd,
 		file:   f,
 		pos:    0,
 	}, nil
 }
 
+// Close closes the archive. It waits for pending reads to finish.
+// Afterwards, all files opened from r return fs.ErrClosed.
+func (r *Reader) Close() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.closed {
+		return fs.ErrClosed
+	}
+	r.closed = true
+	r.cache = nil
+	return r.fd.Close()
+}
+
+// pread reads the archive at off. It fails with fs.ErrClosed after Close.
+func (r *Reader) pread(p []byte, off int64) (int, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	if r.closed {
+		return 0, fs.ErrClosed
+	}
+	return r.fd.ReadAt(p, off)
+}
+
+func (r *Reader) getCache() *blockCache {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return r.cache
+}
+
 type fileHeader struct {
 	// For reader, it's base name.
 	// For writer, it's full name.
@@ -229,43 +336,184 @@ func (f *fileHeader) Sys() any           { return nil }
 // File represents a file in the archive.
 type File struct {
 	fileHeader
-	Name string // full name
+	Name   string // full name
+	reader *Reader
 }
 
 func (f *File) FileInfo() fs.FileInfo {
 	return &f.fileHeader
 }
 
+// Offset returns the offset of the content in the archive file.
+func (f *File) Offset() int64 {
+	return f.offset
+}
+
+// ReadAt reads the file content at off without opening it.
+// It is safe for concurrent use.
+func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
+	if cache := f.reader.getCache(); cache != nil {
+		return f.reader.readCached(cache, f, p, off, 0)
+	}
+	return f.reader.readAt(f, p, off)
+}
+
+// readAt decrypts len(p) bytes of f starting at off.
+// Only positional reads are used, so no state is shared between calls.
+func (r *Reader) readAt(f *File, p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fs.ErrInvalid
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	if off+int64(len(p)) > f.size {
+		p = p[:f.size-off]
+		err = io.EOF
+	}
+
+	start := f.offset + off
+	s := start / 16 * 16
+	e := (start + int64(len(p)) + 15) / 16 * 16
+	buf := make([]byte, e-s)
+	if _, rerr := r.pread(buf, s); rerr != nil {
+		return 0, rerr
+	}
+
+	r.xorKeyStream(buf, buf, s)
+	n = copy(p, buf[start%16:])
+	return n, err
+}
+
 // FileDesc represents an open file for read.
+//
+// Besides Read and Seek, FileDesc implements io.ReaderAt, so it can be
+// wrapped by io.NewSectionReader and read concurrently.
 type FileDesc struct {
 	reader *Reader
-	fd     *os.File
 	file   *File
 	pos    int64
+	closed bool
+
+	// next and ra track sequential reads for readahead.
+	next int64
+	ra   int
 }
 
 func (f *FileDesc) Read(p []byte) (n int, err error) {
-	if f.pos == f.file.size {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if f.pos >= f.file.size {
 		return 0, io.EOF
 	}
-
-	off := f.file.offset + f.pos
-	s := off / 16 * 16
 	if f.pos+int64(len(p)) > f.file.size {
 		p = p[:f.file.size-f.pos]
 	}
-	e := (off + int64(len(p)) + 15) / 16 * 16
+	if cache := f.reader.getCache(); cache != nil {
+		if f.pos != f.next {
+			f.ra = 0
+		} else if f.ra == 0 {
+			f.ra = 1
+		} else if f.ra < maxReadahead {
+			f.ra *= 2
+		}
+		n, err = f.reader.readCached(cache, f.file, p, f.pos, f.ra)
+	} else {
+		n, err = f.reader.readAt(f.file, p, f.pos)
+	}
+	f.pos += int64(n)
+	f.next = f.pos
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
 
-	buf := make([]byte, e-s)
-	_, err = f.fd.ReadAt(buf, s)
-	if err != nil {
-		return 0, err
+// ReadAt implements io.ReaderAt. It doesn't change the offset of Read.
+func (f *FileDesc) ReadAt(p []byte, off int64) (n int, err error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	return f.file.ReadAt(p, off)
+}
+
+// Size returns the size of the file, as needed by io.NewSectionReader.
+func (f *FileDesc) Size() int64 {
+	return f.file.size
+}
+
+// WriteTo implements io.WriterTo. It writes the rest of the file to w.
+// Like Read, it reads the shared fd, so it fails with fs.ErrClosed once
+// the Reader is closed.
+//
+// For unencrypted archives, the data is copied by sendfile on Linux when
+// w is a file or a socket, which never enters user space. Otherwise, it's
+// copied in chunks of the write buffer size.
+func (f *FileDesc) WriteTo(w io.Writer) (n int64, err error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	return f.writeTo(w, f.file.size-f.pos)
+}
+
+// writeTo writes at most limit bytes of the file to w, fewer only at the
+// end of the file or on error.
+func (f *FileDesc) writeTo(w io.Writer, limit int64) (n int64, err error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if rest := f.file.size - f.pos; limit > rest {
+		limit = rest
 	}
+	if limit <= 0 {
+		return 0, nil
+	}
+
+	if f.reader.block == nil {
+		n, handled, err := f.reader.sendFile(w, f.file.offset+f.pos, limit)
+		f.pos += n
+		if handled || err != nil {
+			return n, err
+		}
+	}
+
+	buf := make([]byte, writeBufSize)
+	for n < limit {
+		p := buf
+		if int64(len(p)) > limit-n {
+			p = p[:limit-n]
+		}
+		m, rerr := f.Read(p)
+		if m > 0 {
+			wm, werr := w.Write(p[:m])
+			n += int64(wm)
+			if werr != nil {
+				return n, werr
+			}
+			if wm < m {
+				return n, io.ErrShortWrite
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+	return n, nil
+}
 
-	f.reader.xorKeyStream(buf, buf, s)
-	copy(p, buf[off%16:])
-	f.pos += int64(len(p))
-	return len(p), nil
+// sendFile copies n bytes of the archive at off to w in the kernel. It
+// holds the read lock throughout, so that fd isn't closed meanwhile.
+func (r *Reader) sendFile(w io.Writer, off, n int64) (int64, bool, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	if r.closed {
+		return 0, true, fs.ErrClosed
+	}
+	return sendFile(w, r.fd, off, n)
 }
 
 func (f *FileDesc) Write(p []byte) (n int, err error) {
@@ -273,6 +521,9 @@ func (f *FileDesc) Write(p []byte) (n int, err error) {
 }
 
 func (f *FileDesc) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
 	switch whence {
 	case io.SeekStart:
 		f.pos = offset
@@ -288,17 +539,23 @@ func (f *FileDesc) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (f *FileDesc) Close() error {
-	return f.reader.fdCache.release(f.fd)
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	return nil
 }
 
 func (f *FileDesc) Stat() (fs.FileInfo, error) {
 	return f.file.FileInfo(), nil
 }
 
-func (r *Reader) SetFdCacheSize(size int) {
-	r.fdCache.size = size
-}
+// SetFdCacheSize does nothing.
+//
+// Deprecated: Reader uses a single shared fd now.
+func (r *Reader) SetFdCacheSize(size int) {}
 
-func (r *Reader) SetFdCacheTimeout(timeout time.Duration) {
-	r.fdCache.timeout = timeout
-}
+// SetFdCacheTimeout does nothing.
+//
+// Deprecated: Reader uses a single shared fd now.
+func (r *Reader) SetFdCacheTimeout(timeout time.Duration) {}
@@ -0,0 +1,210 @@
+package quicktar
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const fuzzPassword = "password"
+
+// fuzzCipher returns the cipher of level enc with fuzzPassword. The nonce
+// is set by the reader.
+func fuzzCipher(enc uint8) Cipher {
+	return NewCipher(int(enc%4), []byte(fuzzPassword))
+}
+
+// fuzzFiles returns n files for seed archives, including a directory
+// and an empty file.
+func fuzzFiles(n int) []testFile {
+	files := []testFile{
+		{"d/", nil},
+		{"d/a", []byte("hello\n")},
+		{"d/e", nil},
+		{"big", []byte(strings.Repeat("x", 100))},
+	}
+	for i := len(files); i < n; i++ {
+		files = append(files, testFile{fmt.Sprintf("d/f%d", i), nil})
+	}
+	return files
+}
+
+// addSeeds adds plain, indexed, encrypted and legacy archives to the
+// corpus, including an index of two pages.
+func addSeeds(f *testing.F) {
+	dir := f.TempDir()
+	for _, enc := range []uint8{EncNone, EncAES128, EncAES256} {
+		for _, n := range []int{0, 8, indexPageSize + 1} {
+			for _, indexed := range []bool{false, true} {
+				if n > indexPageSize && !indexed {
+					continue
+				}
+				name := filepath.Join(dir, "seed.qtar")
+				cipher := NewCipherNonce(int(enc), []byte(fuzzPassword), nil)
+				writeArchive(f, name, cipher, indexed, fuzzFiles(n)...)
+				data, err := os.ReadFile(name)
+				if err != nil {
+					f.Fatal(err)
+				}
+				f.Add(data, enc)
+			}
+		}
+		f.Add(legacyArchive(enc, fuzzFiles(8)), enc)
+	}
+	f.Add([]byte{}, uint8(0))
+	f.Add([]byte("QuickTar"), uint8(0))
+}
+
+// legacyArchive returns an archive of the older format, which has no
+// header and uses a fixed nonce. Unlike Writer, it allows duplicate names.
+func legacyArchive(enc uint8, files []testFile) []byte {
+	var data, head []byte
+	for _, tf := range files {
+		mode := uint32(0644)
+		name := tf.name
+		if strings.HasSuffix(name, "/") {
+			name = name[:len(name)-1]
+			mode = uint32(fs.ModeDir | 0755)
+		}
+		h := make([]byte, 32)
+		binary.LittleEndian.PutUint64(h, uint64(len(data)))
+		binary.LittleEndian.PutUint64(h[8:], uint64(len(tf.data)))
+		binary.LittleEndian.PutUint32(h[16:], mode)
+		head = append(head, h...)
+		data = append(data, tf.data...)
+		for len(data)%32 != 0 {
+			data = append(data, 0)
+		}
+	}
+	start := len(data)
+	data = append(data, head...)
+	for _, tf := range files {
+		data = append(data, strings.TrimSuffix(tf.name, "/")...)
+		data = append(data, 0)
+	}
+	for len(data)%32 != 0 {
+		data = append(data, 0)
+	}
+	trailer := make([]byte, 32)
+	binary.LittleEndian.PutUint64(trailer, uint64(start))
+	binary.LittleEndian.PutUint64(trailer[8:], uint64(len(files)))
+	data = append(data, trailer...)
+
+	cipher := fuzzCipher(enc)
+	cipher.setNonceBytes(append(append([]byte(nil), deprecatedNonce...), make([]byte, 8)...))
+	cipher.xorKeyStream(data, data, 0)
+	return data
+}
+
+// openFuzz writes data to a file and opens it.
+func openFuzz(t *testing.T, data []byte) *os.File {
+	name := filepath.Join(t.TempDir(), "fuzz.qtar")
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fd.Close() })
+	return fd
+}
+
+// checkFuzzErr fails t unless err is nil, one of the errors of opening an
+// archive, or an I/O error.
+func checkFuzzErr(t *testing.T, err error) {
+	var pe *fs.PathError
+	switch {
+	case err == nil,
+		errors.Is(err, ErrBadMagic),
+		errors.Is(err, ErrWrongPassword),
+		errors.Is(err, ErrCorrupt),
+		errors.Is(err, ErrTruncated),
+		errors.As(err, &pe):
+	default:
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// checkFuzzFiles fails t if a file read without error breaks what readers
+// rely on.
+func checkFuzzFiles(t *testing.T, files []*File) {
+	for _, f := range files {
+		if err := checkName(f.Name); err != nil {
+			t.Fatalf("bad name %q accepted: %v", f.Name, err)
+		}
+	}
+}
+
+func FuzzReadMeta(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte, enc uint8) {
+		fd := openFuzz(t, data)
+		cipher := fuzzCipher(enc)
+		var m metaInfo
+		// The fallback to the older format is covered by FuzzReadHeader.
+		files, err := readMeta(fd, &cipher, &m, false)
+		checkFuzzErr(t, err)
+		if err != nil {
+			return
+		}
+		if m.start < 32 || m.start > m.end || m.end > int64(len(data)) || len(files) != m.count {
+			t.Fatalf("bad meta info %+v of %d bytes with %d files", m, len(data), len(files))
+		}
+		checkFuzzFiles(t, files)
+	})
+}
+
+func FuzzReadHeader(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte, enc uint8) {
+		fd := openFuzz(t, data)
+		cipher := fuzzCipher(enc)
+		cipher.setNonceBytes(append(append([]byte(nil), deprecatedNonce...), make([]byte, 8)...))
+		var m metaInfo
+		files, err := readHeader(fd, cipher, &m)
+		checkFuzzErr(t, err)
+		if err != nil {
+			return
+		}
+		if m.start < 0 || m.start > m.end || len(files) != m.count {
+			t.Fatalf("bad meta info %+v of %d bytes with %d files", m, len(data), len(files))
+		}
+		checkFuzzFiles(t, files)
+	})
+}
+
+func FuzzReadIndex(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte, enc uint8) {
+		fd := openFuzz(t, data)
+		cipher := fuzzCipher(enc)
+		m, err := readTrailer(fd, &cipher)
+		checkFuzzErr(t, err)
+		if err != nil || !m.indexed {
+			return
+		}
+		index, err := readIndex(fd, &cipher, m)
+		checkFuzzErr(t, err)
+		if err != nil {
+			return
+		}
+
+		// Read all pages, as done by lookups
+		r := &Reader{Cipher: cipher, fd: fd, meta: m, index: index}
+		files, err := r.allFiles()
+		checkFuzzErr(t, err)
+		if err != nil {
+			return
+		}
+		if len(files) != m.count {
+			t.Fatalf("index has %d files, but the trailer says %d", len(files), m.count)
+		}
+		checkFuzzFiles(t, files)
+	})
+}
@@ -0,0 +1,239 @@
+package quicktar
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+type testFile struct {
+	name string
+	data []byte
+}
+
+// writeArchive creates an archive of files at name.
+func writeArchive(tb testing.TB, name string, cipher Cipher, indexed bool, files ...testFile) {
+	tb.Helper()
+	w, err := NewWriter(name, cipher)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	w.SetMetaIndex(indexed)
+	for _, tf := range files {
+		f, err := w.Create(tf.name)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if _, err := f.Write(tf.data); err != nil {
+			tb.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// writeToDest is a destination of FileDesc.WriteTo, whose content is
+// returned by done.
+type writeToDest struct {
+	name string
+	open func(t *testing.T) (w io.Writer, done func() []byte)
+}
+
+var writeToDests = []writeToDest{
+	{"Buffer", func(t *testing.T) (io.Writer, func() []byte) {
+		var b bytes.Buffer
+		return &b, b.Bytes
+	}},
+	{"File", func(t *testing.T) (io.Writer, func() []byte) {
+		return openDest(t, os.O_RDWR)
+	}},
+	{"AppendFile", func(t *testing.T) (io.Writer, func() []byte) {
+		return openDest(t, os.O_RDWR|os.O_APPEND)
+	}},
+	{"Pipe", func(t *testing.T) (io.Writer, func() []byte) {
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ch := make(chan []byte)
+		go func() {
+			b, _ := io.ReadAll(pr)
+			pr.Close()
+			ch <- b
+		}()
+		return pw, func() []byte {
+			pw.Close()
+			return <-ch
+		}
+	}},
+}
+
+func openDest(t *testing.T, flag int) (io.Writer, func() []byte) {
+	name := filepath.Join(t.TempDir(), "dest")
+	f, err := os.OpenFile(name, flag|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Data must go after what's written before
+	f.Write([]byte("head"))
+	return f, func() []byte {
+		f.Close()
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(b, []byte("head")) {
+			t.Fatal("WriteTo overwrote the start of the file")
+		}
+		return b[4:]
+	}
+}
+
+func TestFileDescWriteTo(t *testing.T) {
+	data := make([]byte, 3*writeBufSize+5)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	for _, c := range benchCiphers {
+		name := filepath.Join(t.TempDir(), "test.qtar")
+		writeArchive(t, name, c.cipher(), false, testFile{"a", []byte("x")}, testFile{"b", data})
+		r, err := OpenReader(name, c.cipher())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, d := range writeToDests {
+			t.Run(c.name+"/"+d.name, func(t *testing.T) {
+				fd, err := r.Open(r.File[1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := fd.Seek(3, io.SeekStart); err != nil {
+					t.Fatal(err)
+				}
+				w, done := d.open(t)
+				n, err := fd.WriteTo(w)
+				got := done()
+				if err != nil || n != int64(len(data)-3) {
+					t.Fatalf("WriteTo = %d, %v", n, err)
+				}
+				if !bytes.Equal(got, data[3:]) {
+					t.Fatal("WriteTo wrote wrong data")
+				}
+				if n, err := fd.WriteTo(w); n != 0 || err != nil {
+					t.Fatalf("WriteTo at EOF = %d, %v", n, err)
+				}
+			})
+		}
+
+		fd, err := r.Open(r.File[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fd.WriteTo(shortWriter{}); err != io.ErrShortWrite {
+			t.Errorf("%s: short write = %v, want %v", c.name, err, io.ErrShortWrite)
+		}
+		fd.Seek(0, io.SeekStart)
+		r.Close()
+		if _, err := fd.WriteTo(io.Discard); !errors.Is(err, fs.ErrClosed) {
+			t.Fatalf("%s: WriteTo after Close = %v, want %v", c.name, err, fs.ErrClosed)
+		}
+	}
+}
+
+func TestSendFile(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("sendfile is only used on Linux")
+	}
+	data := []byte("0123456789abcdef")
+	name := filepath.Join(t.TempDir(), "test.qtar")
+	writeArchive(t, name, Store, false, testFile{"a", data})
+	r, err := OpenReader(name, Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// The kernel refuses files opened for append, which WriteTo copies by
+	// itself.
+	for _, d := range writeToDests {
+		w, done := d.open(t)
+		n, handled, err := r.sendFile(w, r.File[0].offset+2, 10)
+		got := done()
+		want := d.name == "File" || d.name == "Pipe"
+		if handled != want || err != nil {
+			t.Errorf("%s: sendFile = %d, %v, %v, want handled %v", d.name, n, handled, err, want)
+		} else if handled && (n != 10 || !bytes.Equal(got, data[2:12])) {
+			t.Errorf("%s: sendFile wrote %q", d.name, got)
+		}
+	}
+
+	// The archive is shorter than asked
+	w, done := writeToDests[1].open(t)
+	_, _, err = r.sendFile(w, r.File[0].offset, 1<<20)
+	done()
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("sendFile past the end = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+// shortWriter writes half of each buffer without an error.
+type shortWriter struct{}
+
+func (shortWriter) Write(p []byte) (int, error) { return len(p) / 2, nil }
+
+func BenchmarkFileDescRead(b *testing.B) {
+	const size = 64 << 20
+	for _, c := range benchCiphers {
+		b.Run(c.name, func(b *testing.B) {
+			name := filepath.Join(b.TempDir(), "bench.qtar")
+			writeArchive(b, name, c.cipher(), false, testFile{"file", make([]byte, size)})
+			buf := make([]byte, writeBufSize)
+
+			r, err := OpenReader(name, c.cipher())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer r.Close()
+			fd, err := r.Open(r.File[0])
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer fd.Close()
+
+			b.SetBytes(int64(len(buf)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := io.ReadFull(fd, buf); err == io.EOF {
+					fd.Seek(0, io.SeekStart)
+					i--
+				} else if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseMetaNames(t *testing.T) {
+	head := make([]byte, 64)
+	for _, names := range []string{"a\x00", "a\x00\x00", "a\x00/b\x00", "a\x00b"} {
+		_, err := parseMeta(append(head[:64:64], names...), 2)
+		if !errors.Is(err, ErrCorrupt) {
+			t.Errorf("names %q: got %v, want %v", names, err, ErrCorrupt)
+		}
+	}
+	files, err := parseMeta(append(head[:64:64], "a\x00a/b\x00\x00\x00"...), 2)
+	if err != nil || files[1].Name != "a/b" {
+		t.Errorf("valid names: got %v, %v", files, err)
+	}
+}
@@ -0,0 +1,297 @@
+package quicktar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+// Rekey re-encrypts the archive in place, e.g. to change the password or
+// the encryption level, where Store is also allowed. new should have a
+// fresh nonce, as given by NewCipherNonce with a nil nonce.
+//
+// Rekey keeps an undo journal next to the archive, named with suffix
+// ".rekey", which saves the original data of the chunk being rewritten.
+// If Rekey is interrupted, e.g. by a crash, the archive is unreadable
+// until Rekey is called again with the same passwords, which resumes
+// from the journal with the nonce recorded in it.
+//
+// Archives of the older format can't be rekeyed.
+func Rekey(name string, old, new Cipher) error {
+	fd, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	j, err := openJournal(name+rekeySuffix, fd, &old, &new)
+	if err != nil {
+		return err
+	}
+	if err := j.run(fd, &old, &new); err != nil {
+		j.fd.Close()
+		return err
+	}
+	j.fd.Close()
+	return os.Remove(j.fd.Name())
+}
+
+// ErrBadJournal is returned by Rekey when the journal of an interrupted
+// Rekey isn't one, or its header is incomplete.
+var ErrBadJournal = errors.New("bad rekey journal")
+
+const (
+	rekeySuffix    = ".rekey"
+	rekeyMagic     = "QTRekey\x00"
+	rekeyChunkSize = 4 << 20
+
+	// The journal starts with a header, followed by two slots written in
+	// turn, so that one of them is always complete.
+	//
+	//	header struct {
+	//	    magic    [8]byte
+	//	    end      int64    // end of the archive
+	//	    oldNonce [16]byte
+	//	    newNonce [16]byte
+	//	    oldCheck [16]byte // keystreams at offset 0, which are
+	//	    newCheck [16]byte // not used by data
+	//	}
+	//	slot struct {
+	//	    seq  int64        // 0 if never written
+	//	    done int64        // data before done is re-encrypted
+	//	    size int64
+	//	    crc  uint32       // of the fields above and data
+	//	    _    [4]byte
+	//	    data [size]byte   // the original data at done
+	//	}
+	rekeyHeaderSize = 80
+	rekeySlotSize   = 32 + rekeyChunkSize
+)
+
+type rekeyJournal struct {
+	fd   *os.File
+	end  int64
+	seq  int64
+	done int64
+}
+
+// nonceBytes returns the nonce as stored in the header, i.e. zeros for
+// Store.
+func (c *Cipher) nonceBytes() []byte {
+	b := make([]byte, 16)
+	if c.block != nil {
+		binary.BigEndian.PutUint64(b, c.nonce[0])
+		binary.BigEndian.PutUint64(b[8:], c.nonce[1])
+	}
+	return b
+}
+
+func (c *Cipher) setNonceBytes(b []byte) {
+	if c.block != nil {
+		c.nonce = []uint64{
+			binary.BigEndian.Uint64(b),
+			binary.BigEndian.Uint64(b[8:]),
+		}
+	}
+}
+
+// check returns the keystream at offset 0, which tells whether two
+// ciphers are the same.
+func (c *Cipher) check() []byte {
+	b := make([]byte, 16)
+	c.xorKeyStream(b, b, 0)
+	return b
+}
+
+// openJournal resumes the journal at name if it exists, or creates one.
+// The nonces of old and new are set as the journal says.
+func openJournal(name string, fd *os.File, old, new *Cipher) (*rekeyJournal, error) {
+	jfd, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err == nil {
+		j, err := resumeJournal(jfd, fd, old, new)
+		if err != nil {
+			jfd.Close()
+			return nil, fmt.Errorf("resume %s: %w", name, err)
+		}
+		return j, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Check the old password
+	m, err := readTrailer(fd, old)
+	if err != nil {
+		return nil, err
+	}
+
+	jfd, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, rekeyHeaderSize)
+	copy(header, rekeyMagic)
+	binary.LittleEndian.PutUint64(header[8:], uint64(m.end))
+	copy(header[16:], old.nonceBytes())
+	copy(header[32:], new.nonceBytes())
+	copy(header[48:], old.check())
+	copy(header[64:], new.check())
+	_, err = jfd.WriteAt(header, 0)
+	if err == nil {
+		err = jfd.Sync()
+	}
+	if err == nil {
+		err = SyncDir(name)
+	}
+	if err != nil {
+		jfd.Close()
+		os.Remove(name)
+		return nil, err
+	}
+	return &rekeyJournal{fd: jfd, end: m.end, done: 32}, nil
+}
+
+// resumeJournal reads the journal and undoes the interrupted chunk.
+func resumeJournal(jfd, fd *os.File, old, new *Cipher) (*rekeyJournal, error) {
+	header := make([]byte, rekeyHeaderSize)
+	if err := readFull(jfd, header, 0); err == ErrTruncated {
+		return nil, ErrBadJournal
+	} else if err != nil {
+		return nil, err
+	}
+	if string(header[:8]) != rekeyMagic {
+		return nil, ErrBadJournal
+	}
+	old.setNonceBytes(header[16:32])
+	new.setNonceBytes(header[32:48])
+	if !bytes.Equal(old.check(), header[48:64]) || !bytes.Equal(new.check(), header[64:80]) {
+		return nil, ErrWrongPassword
+	}
+	j := &rekeyJournal{fd: jfd, end: int64(binary.LittleEndian.Uint64(header[8:]))}
+
+	// Find the latest complete slot
+	var data []byte
+	for i := int64(0); i < 2; i++ {
+		seq, done, d, err := j.readSlot(i)
+		if err != nil {
+			return nil, err
+		}
+		if seq > j.seq {
+			j.seq, j.done, data = seq, done, d
+		}
+	}
+	if j.seq == 0 {
+		j.done = 32 // nothing is written yet
+		return j, nil
+	}
+	if _, err := fd.WriteAt(data, j.done); err != nil {
+		return nil, err
+	}
+	return j, fd.Sync()
+}
+
+// readSlot returns the slot, or zero seq if it's incomplete.
+func (j *rekeyJournal) readSlot(i int64) (seq, done int64, data []byte, err error) {
+	off := rekeyHeaderSize + i*rekeySlotSize
+	head := make([]byte, 32)
+	if err := readFull(j.fd, head, off); err == ErrTruncated {
+		return 0, 0, nil, nil
+	} else if err != nil {
+		return 0, 0, nil, err
+	}
+	seq = int64(binary.LittleEndian.Uint64(head))
+	done = int64(binary.LittleEndian.Uint64(head[8:]))
+	size := int64(binary.LittleEndian.Uint64(head[16:]))
+	if seq <= 0 || size < 0 || size > rekeyChunkSize || done < 32 || done > j.end-size {
+		return 0, 0, nil, nil
+	}
+	data = make([]byte, size)
+	if err := readFull(j.fd, data, off+32); err == ErrTruncated {
+		return 0, 0, nil, nil
+	} else if err != nil {
+		return 0, 0, nil, err
+	}
+	crc := crc32.ChecksumIEEE(head[:24])
+	crc = crc32.Update(crc, crc32.IEEETable, data)
+	if crc != binary.LittleEndian.Uint32(head[24:]) {
+		return 0, 0, nil, nil
+	}
+	return seq, done, data, nil
+}
+
+// writeSlot saves the original data at done before it's overwritten.
+func (j *rekeyJournal) writeSlot(data []byte) error {
+	j.seq++
+	buf := make([]byte, 32+len(data))
+	binary.LittleEndian.PutUint64(buf, uint64(j.seq))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(j.done))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(len(data)))
+	crc := crc32.ChecksumIEEE(buf[:24])
+	crc = crc32.Update(crc, crc32.IEEETable, data)
+	binary.LittleEndian.PutUint32(buf[24:], crc)
+	copy(buf[32:], data)
+	if _, err := j.fd.WriteAt(buf, rekeyHeaderSize+(j.seq%2)*rekeySlotSize); err != nil {
+		return err
+	}
+	return j.fd.Sync()
+}
+
+// run re-encrypts the data from done, then updates the header.
+func (j *rekeyJournal) run(fd *os.File, old, new *Cipher) error {
+	buf := make([]byte, rekeyChunkSize)
+	for j.done < j.end {
+		if err := j.step(fd, buf, old, new); err != nil {
+			return err
+		}
+	}
+
+	// Write the new nonce
+	if _, err := fd.WriteAt(new.nonceBytes(), 16); err != nil {
+		return err
+	}
+	return fd.Sync()
+}
+
+// step re-encrypts the chunk at done, using buf of rekeyChunkSize bytes.
+func (j *rekeyJournal) step(fd *os.File, buf []byte, old, new *Cipher) error {
+	n := j.end - j.done
+	if n > rekeyChunkSize {
+		n = rekeyChunkSize
+	}
+	p := buf[:n]
+	if err := readFull(fd, p, j.done); err != nil {
+		return err
+	}
+	if err := j.writeSlot(p); err != nil {
+		return err
+	}
+	old.xorKeyStreamParallel(p, p, j.done)
+	new.xorKeyStreamParallel(p, p, j.done)
+	if _, err := fd.WriteAt(p, j.done); err != nil {
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		return err
+	}
+	j.done += n
+	return nil
+}
+
+// SyncDir flushes the directory containing name, so that a file just
+// created, linked or renamed to name survives a crash. It does nothing on
+// systems where directories can't be synced.
+func SyncDir(name string) error {
+	d, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package quicktar
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// rekeyFiles returns files that span several chunks of Rekey.
+func rekeyFiles() []testFile {
+	rnd := rand.New(rand.NewSource(1))
+	var files []testFile
+	for i := 0; i < 3; i++ {
+		data := make([]byte, rekeyChunkSize+rekeyChunkSize/3)
+		rnd.Read(data)
+		files = append(files, testFile{fmt.Sprint("f", i), data})
+	}
+	return files
+}
+
+// interruptRekey rekeys the archive at name by the given chunks, then
+// stops as if by a crash. If tear is "data", the next chunk is saved to
+// the journal and then partly overwritten; if it's "slot", the slot of the
+// next chunk is saved with a bad checksum.
+func interruptRekey(t *testing.T, name string, old, new Cipher, chunks int, tear string) {
+	fd, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	j, err := openJournal(name+rekeySuffix, fd, &old, &new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.fd.Close()
+
+	buf := make([]byte, rekeyChunkSize)
+	for i := 0; i < chunks; i++ {
+		if err := j.step(fd, buf, &old, &new); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tear == "" {
+		return
+	}
+	if err := readFull(fd, buf, j.done); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.writeSlot(buf); err != nil {
+		t.Fatal(err)
+	}
+	junk := bytes.Repeat([]byte{0xff}, rekeyChunkSize/2)
+	switch tear {
+	case "data":
+		_, err = fd.WriteAt(junk, j.done)
+	case "slot":
+		_, err = j.fd.WriteAt(junk, rekeyHeaderSize+(j.seq%2)*rekeySlotSize+32)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRekeyResume(t *testing.T) {
+	files := rekeyFiles()
+	for _, c := range []struct {
+		name           string
+		oldEnc, newEnc int
+		oldPwd, newPwd string
+	}{
+		{"StoreToAES", EncNone, EncAES256, "", "new"},
+		{"AESToStore", EncAES256, EncNone, "old", ""},
+		{"AESToAES", EncAES128, EncAES256, "old", "new"},
+	} {
+		oldCipher := func() Cipher { return NewCipher(c.oldEnc, []byte(c.oldPwd)) }
+		newCipher := func() Cipher { return NewCipherNonce(c.newEnc, []byte(c.newPwd), nil) }
+		for _, chunks := range []int{0, 1, 3} {
+			for _, tear := range []string{"", "data", "slot"} {
+				desc := fmt.Sprintf("%s, %d chunks, torn %q", c.name, chunks, tear)
+				name := filepath.Join(t.TempDir(), "test.qtar")
+				writeArchive(t, name, NewCipherNonce(c.oldEnc, []byte(c.oldPwd), nil), false, files...)
+				interruptRekey(t, name, oldCipher(), newCipher(), chunks, tear)
+
+				// The journal keeps the nonce of the interrupted Rekey
+				if err := Rekey(name, oldCipher(), newCipher()); err != nil {
+					t.Fatalf("%s: %v", desc, err)
+				}
+				if _, err := os.Stat(name + rekeySuffix); !os.IsNotExist(err) {
+					t.Errorf("%s: journal is left: %v", desc, err)
+				}
+				checkRekeyed(t, desc, name, NewCipher(c.newEnc, []byte(c.newPwd)), files)
+			}
+		}
+	}
+}
+
+// checkRekeyed checks that the archive at name has files with cipher.
+func checkRekeyed(t *testing.T, desc, name string, cipher Cipher, files []testFile) {
+	r, err := OpenReader(name, cipher)
+	if err != nil {
+		t.Fatalf("%s: %v", desc, err)
+	}
+	defer r.Close()
+	if errs := r.Validate(); errs != nil {
+		t.Fatalf("%s: %v", desc, errs)
+	}
+	if len(r.File) != len(files) {
+		t.Fatalf("%s: %d files, want %d", desc, len(r.File), len(files))
+	}
+	for i, f := range r.File {
+		data := make([]byte, f.Size())
+		if _, err := f.ReadAt(data, 0); err != nil {
+			t.Fatalf("%s: %s: %v", desc, f.Name, err)
+		}
+		if f.Name != files[i].name || !bytes.Equal(data, files[i].data) {
+			t.Fatalf("%s: %s has wrong content", desc, f.Name)
+		}
+	}
+}
+
+func TestRekeyBadJournal(t *testing.T) {
+	files := []testFile{{"a", []byte("hello")}}
+	cipher := func() Cipher { return NewCipherNonce(EncAES256, []byte("password"), nil) }
+	for _, journal := range []string{"", "QTRekey", "not a journal" + string(make([]byte, rekeyHeaderSize))} {
+		name := filepath.Join(t.TempDir(), "test.qtar")
+		writeArchive(t, name, cipher(), false, files...)
+		if err := os.WriteFile(name+rekeySuffix, []byte(journal), 0600); err != nil {
+			t.Fatal(err)
+		}
+		err := Rekey(name, NewCipher(EncAES256, []byte("password")), cipher())
+		if !errors.Is(err, ErrBadJournal) {
+			t.Errorf("journal %q: got %v, want %v", journal, err, ErrBadJournal)
+		}
+		checkRekeyed(t, fmt.Sprintf("journal %q", journal), name, NewCipher(EncAES256, []byte("password")), files)
+	}
+}
@@ -0,0 +1,73 @@
+//go:build linux
+
+package quicktar
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// maxSendfileSize limits each sendfile call, whose count is an int.
+const maxSendfileSize = 1 << 30
+
+// sendFile copies n bytes of src at off to w by sendfile(2). The offset is
+// passed explicitly, so the position of src is neither used nor changed.
+// It reports false if w has no fd or the kernel refuses to copy between
+// them before anything is written, in which case the caller should copy
+// by itself.
+func sendFile(w io.Writer, src *os.File, off, n int64) (written int64, handled bool, err error) {
+	sc, ok := w.(syscall.Conn)
+	if !ok {
+		return 0, false, nil
+	}
+	dst, err := sc.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	srcConn, err := src.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+
+	handled = true
+	cerr := srcConn.Control(func(sfd uintptr) {
+		werr := dst.Write(func(dfd uintptr) bool {
+			for n > 0 {
+				count := n
+				if count > maxSendfileSize {
+					count = maxSendfileSize
+				}
+				m, serr := syscall.Sendfile(int(dfd), int(sfd), &off, int(count))
+				if m > 0 {
+					written += int64(m)
+					n -= int64(m)
+				}
+				switch {
+				case serr == syscall.EINTR:
+				case serr == syscall.EAGAIN:
+					return false // wait for w to be writable
+				case serr != nil:
+					if written == 0 && (serr == syscall.EINVAL || serr == syscall.ENOSYS ||
+						serr == syscall.EOPNOTSUPP || serr == syscall.EBADF) {
+						handled = false
+					} else {
+						err = os.NewSyscallError("sendfile", serr)
+					}
+					return true
+				case m == 0:
+					err = io.ErrUnexpectedEOF // src is shorter than expected
+					return true
+				}
+			}
+			return true
+		})
+		if err == nil {
+			err = werr
+		}
+	})
+	if err == nil {
+		err = cerr
+	}
+	return written, handled, err
+}
@@ -0,0 +1,68 @@
+package quicktar
+
+import (
+	"io"
+	"os"
+)
+
+// spoolMemSize is the size of data a spool keeps in memory before it
+// spills to a temporary file.
+const spoolMemSize = 4 << 20
+
+// spool holds the content of a file written while another file owns
+// the stream of Writer.
+type spool struct {
+	buf  []byte
+	file *os.File
+
+	// err is the first error of Write, which io.Copy would mix up with
+	// errors of reading.
+	err error
+}
+
+func (s *spool) Write(p []byte) (n int, err error) {
+	defer func() {
+		if err != nil && s.err == nil {
+			s.err = err
+		}
+	}()
+	if s.file == nil && len(s.buf)+len(p) <= spoolMemSize {
+		s.buf = append(s.buf, p...)
+		return len(p), nil
+	}
+	if s.file == nil {
+		if s.file, err = os.CreateTemp("", "quicktar-spool-"); err != nil {
+			return 0, err
+		}
+		if _, err = s.file.Write(s.buf); err != nil {
+			return 0, err
+		}
+		s.buf = nil
+	}
+	return s.file.Write(p)
+}
+
+// writeTo copies the content to the stream of w.
+func (s *spool) writeTo(w *Writer) error {
+	if s.file == nil {
+		_, err := w.write(s.buf)
+		return err
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := w.readFrom(s.file)
+	return err
+}
+
+// discard releases the memory and removes the temporary file.
+func (s *spool) discard() error {
+	s.buf = nil
+	if s.file == nil {
+		return nil
+	}
+	name := s.file.Name()
+	s.file.Close()
+	s.file = nil
+	return os.Remove(name)
+}
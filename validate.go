@@ -0,0 +1,105 @@
+package quicktar
+
+import (
+	"fmt"
+	"io/fs"
+	"sort"
+)
+
+// Validate checks the structure of the archive and returns the problems
+// found, or nil if there is none. It checks that
+//   - the header agrees with the archive size and the trailer,
+//   - the content of each file lies within the data region,
+//   - contents don't overlap, and
+//   - no name is duplicated or used as both a file and a directory.
+//
+// Names aren't checked here: a missing or invalid name fails to open with
+// ErrCorrupt, or for a lazy Reader, fails Validate the same way when its
+// page is read. Contents aren't read, since the archive has no checksum
+// for them.
+func (r *Reader) Validate() []error {
+	var errs []error
+	report := func(format string, a ...any) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	// Check the header and the trailer
+	info := r.Info()
+	if fi, err := r.fd.Stat(); err != nil {
+		report("stat: %w", err)
+	} else if fi.Size() != info.MetaEnd {
+		report("archive size %d differs from end of meta %d", fi.Size(), info.MetaEnd)
+	}
+	if info.MetaStart%32 != 0 {
+		report("meta starts at %d, which isn't 32-byte aligned", info.MetaStart)
+	}
+
+	files, err := r.allFiles()
+	if err != nil {
+		return append(errs, err)
+	}
+	if len(files) != info.Count {
+		report("meta has %d files, but the trailer says %d", len(files), info.Count)
+	}
+
+	// Check each file
+	names := make(map[string]*File, len(files))
+	type extent struct {
+		f        *File
+		off, end int64
+	}
+	extents := make([]extent, 0, len(files))
+	for _, f := range files {
+		if names[f.Name] != nil {
+			report("%s: duplicate name", f.Name)
+		}
+		names[f.Name] = f
+
+		switch f.Mode() & fs.ModeType {
+		case 0, fs.ModeSymlink:
+		case fs.ModeDir:
+			if f.Size() != 0 {
+				report("%s: directory with size %d", f.Name, f.Size())
+			}
+			continue
+		default:
+			report("%s: unsupported mode %v", f.Name, f.Mode())
+			continue
+		}
+		if f.Size() == 0 {
+			continue
+		}
+		end := f.offset + f.size
+		if f.offset < info.DataStart || f.size < 0 || end < f.offset || end > info.MetaStart {
+			report("%s: content %d+%d is out of data region %d-%d",
+				f.Name, f.offset, f.size, info.DataStart, info.MetaStart)
+			continue
+		}
+		extents = append(extents, extent{f, f.offset, end})
+	}
+
+	// Check overlapping contents
+	sort.Slice(extents, func(i, j int) bool {
+		return extents[i].off < extents[j].off
+	})
+	for i := 1; i < len(extents); i++ {
+		prev, e := extents[i-1], extents[i]
+		if e.off < prev.end {
+			report("%s: content overlaps with %s", e.f.Name, prev.f.Name)
+		}
+		if e.end < prev.end {
+			extents[i] = prev // keep the extent reaching furthest
+		}
+	}
+
+	// Check parents, which must be directories if present
+	for _, f := range files {
+		for _, p := range Parents(f.Name) {
+			if d := names[p]; d != nil && !d.IsDir() {
+				report("%s: parent %s isn't a directory", f.Name, p)
+				break
+			}
+		}
+	}
+	return errs
+}
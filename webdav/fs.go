@@ -10,8 +10,10 @@ import (
 	"golang.org/x/net/webdav"
 )
 
+// FS merges the archives into one tree. If a name exists in several
+// archives, the last one wins.
 type FS struct {
-	root *File
+	readers []*ctr.Reader
 }
 
 func (_ *FS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
@@ -27,6 +29,7 @@ func (s *FS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMo
 		return nil, fs.ErrPermission
 	}
 	fd := &FileDesc{
+		fs:   s,
 		file: f,
 	}
 	return fd, nil
@@ -52,30 +55,47 @@ func (s *FS) lookup(path string) *File {
 	if len(path) == 0 || path[0] != '/' {
 		return nil
 	}
-	cur := s.root
-	for _, s := range ctr.Split(path[1:]) {
-		if s == "" {
-			break
-		}
-		if next, ok := cur.children[s]; ok {
-			cur = next
-		} else {
-			return nil
+	name := path[1:]
+	if len(name) > 0 && name[len(name)-1] == '/' {
+		name = name[:len(name)-1]
+	}
+	if name == "" {
+		return &File{}
+	}
+	for i := len(s.readers) - 1; i >= 0; i-- {
+		if f, err := s.readers[i].Lookup(name); err == nil {
+			return &File{file: f, reader: s.readers[i]}
 		}
 	}
-	return cur
+	return nil
 }
 
-type File struct {
-	file     *ctr.File
-	reader   *ctr.Reader
-	children map[string]*File
+// readDir lists the directory name ("" for root) in all archives.
+func (s *FS) readDir(name string) []*File {
+	list := make([]*File, 0)
+	index := make(map[string]int)
+	for _, r := range s.readers {
+		files, err := r.ReadDir(name)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			file := &File{file: f, reader: r}
+			if i, ok := index[f.Name]; ok {
+				list[i] = file
+				continue
+			}
+			index[f.Name] = len(list)
+			list = append(list, file)
+		}
+	}
+	return list
 }
 
-func NewFile() *File {
-	return &File{
-		children: make(map[string]*File),
-	}
+// File is a file in one of the archives, or the root if file is nil.
+type File struct {
+	file   *ctr.File
+	reader *ctr.Reader
 }
 
 func (f *File) Name() string {
@@ -113,8 +133,10 @@ func (f *File) IsDir() bool {
 func (f *File) Sys() any { return nil }
 
 type FileDesc struct {
+	fs   *FS
 	file *File
 	fd   *ctr.FileDesc
+	dir  []*File
 }
 
 func (f *FileDesc) init() (err error) {
@@ -151,16 +173,19 @@ func (f *FileDesc) Close() error {
 }
 
 func (f *FileDesc) Readdir(count int) ([]fs.FileInfo, error) {
-	if count > len(f.file.children) || count <= 0 {
-		count = len(f.file.children)
+	if f.dir == nil {
+		name := ""
+		if f.file.file != nil {
+			name = f.file.file.Name
+		}
+		f.dir = f.fs.readDir(name)
+	}
+	if count > len(f.dir) || count <= 0 {
+		count = len(f.dir)
 	}
 	list := make([]fs.FileInfo, 0, count)
-	for _, fi := range f.file.children {
+	for _, fi := range f.dir[:count] {
 		list = append(list, fi)
-		count--
-		if count == 0 {
-			break
-		}
 	}
 	return list, nil
 }
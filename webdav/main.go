@@ -5,7 +5,6 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"time"
 
 	ctr "github.com/lshpku/quicktar"
 	"golang.org/x/net/webdav"
@@ -27,35 +26,17 @@ func main() {
 	}
 	cpr := ctr.NewCipher(*flagEnc, []byte(*flagPwd))
 
-	root := NewFile()
+	readers := make([]*ctr.Reader, 0)
 
 	// Open files
 	for _, name := range flag.Args() {
 		log.Println("opening file", name)
-		r, err := ctr.OpenReader(name, cpr)
+		r, err := ctr.OpenReaderLazy(name, cpr)
 		if err != nil {
 			log.Fatal(err)
 		}
-		r.SetFdCacheSize(0)
-		r.SetFdCacheTimeout(30 * time.Second)
-
-		// Build directory
-		for _, f := range r.File {
-			cur := root
-			for _, s := range ctr.Split(f.Name) {
-				if s == "" {
-					break
-				}
-				next, ok := cur.children[s]
-				if !ok {
-					next = NewFile()
-					cur.children[s] = next
-				}
-				cur = next
-			}
-			cur.file = f
-			cur.reader = r
-		}
+		r.SetBlockCacheSize(64 << 20)
+		readers = append(readers, r)
 	}
 
 	// Start server
@@ -63,7 +44,7 @@ func main() {
 	err := http.ListenAndServe(*flagAddr, &httpHandler{
 		webdav.Handler{
 			FileSystem: &FS{
-				root: root,
+				readers: readers,
 			},
 			LockSystem: webdav.NewMemLS(),
 		},
@@ -7,17 +7,43 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"sort"
+	"sync"
 	"time"
 )
 
+// writeBufSize is the size of the write buffer of Writer.
+const writeBufSize = 1 << 20
+
 // Writer represents an open archive for write.
+//
+// Files may be written concurrently. The first one written owns the
+// stream until it's closed; the others are spooled, and once closed, they
+// are appended whenever the stream is free, in the order of their first
+// write.
 type Writer struct {
 	Cipher
 	fd        *os.File
 	file      []*fileHeader
 	fileIndex map[string]int
-	pos       int64
-	buf       []byte
+
+	// mux guards the fields above and below except pos and buf,
+	// which belong to active if it's not nil.
+	mux     sync.Mutex
+	active  *wfileDesc
+	spooled []*wfileDesc
+	closed  bool
+
+	// pos is the offset of fd. buf holds plaintext to be written at pos,
+	// which is encrypted in place on flush.
+	pos int64
+	buf []byte
+
+	// err is the first error of writing fd, after which buf and pos no
+	// longer match the file, so all further writes fail.
+	err error
+
+	indexed bool
 }
 
 // NewWriter creates a new archive for write.
@@ -49,7 +75,7 @@ func NewWriterFile(f *os.File, cipher Cipher) (*Writer, error) {
 		file:      make([]*fileHeader, 0),
 		fileIndex: make(map[string]int),
 		pos:       32,
-		buf:       make([]byte, 0),
+		buf:       make([]byte, 0, writeBufSize),
 	}, nil
 }
 
@@ -59,12 +85,12 @@ func OpenWriter(name string, cipher Cipher) (*Writer, error) {
 	if err != nil {
 		return nil, err
 	}
-	var metaOff int64
-	files, err := readMeta(f, &cipher, &metaOff)
+	var m metaInfo
+	files, err := readMeta(f, &cipher, &m, false)
 	if err != nil {
 		return nil, err
 	}
-	_, err = f.Seek(metaOff, io.SeekStart)
+	_, err = f.Seek(m.start, io.SeekStart)
 	if err != nil {
 		return nil, err
 	}
@@ -73,8 +99,9 @@ func OpenWriter(name string, cipher Cipher) (*Writer, error) {
 		fd:        f,
 		file:      make([]*fileHeader, 0),
 		fileIndex: make(map[string]int),
-		pos:       metaOff,
-		buf:       make([]byte, 0),
+		pos:       m.start,
+		buf:       make([]byte, 0, writeBufSize),
+		indexed:   m.indexed,
 	}
 	for _, f := range files {
 		h := f.fileHeader
@@ -85,11 +112,21 @@ func OpenWriter(name string, cipher Cipher) (*Writer, error) {
 	return w, nil
 }
 
+// FileWriter represents an open file in the archive for write.
+type FileWriter interface {
+	io.WriteCloser
+
+	// Abort removes the file from the archive. If the file owns the stream,
+	// the stream is rewound to the start of the file, so that no space is
+	// wasted; otherwise, the spooled content is discarded.
+	Abort() error
+}
+
 // Create provides easy access to CreateFile.
 // The name follows the same constraints as CreateFile. However, to create
 // a directory instead of a file, add a trailing slash to the name.
 // Default value for mode is 0666 and modified time is now.
-func (w *Writer) Create(name string) (io.WriteCloser, error) {
+func (w *Writer) Create(name string) (FileWriter, error) {
 	mode := fs.FileMode(0666)
 	uName := []rune(name)
 	if uName[len(uName)-1] == '/' {
@@ -107,30 +144,16 @@ func (w *Writer) Create(name string) (io.WriteCloser, error) {
 //
 // This function doesn't check the file mode. User can write to the returned
 // file regardless of its mode.
-func (w *Writer) CreateFile(name string, mode fs.FileMode, modTime time.Time) (io.WriteCloser, error) {
-	// Check name
-	if name == "" {
-		return nil, errors.New("empty name")
-	}
-	if name[0] == '/' {
-		return nil, errors.New("leading slash")
-	}
-	split := make([]string, 0)
-	lastPos := 0
-	for i, s := range name {
-		if s == '/' {
-			split = append(split, name[lastPos:i])
-			lastPos = i + 1
-			if i == len(name)-1 {
-				return nil, errors.New("trailing slash")
-			}
-		}
+func (w *Writer) CreateFile(name string, mode fs.FileMode, modTime time.Time) (FileWriter, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.closed {
+		return nil, fs.ErrClosed
 	}
-	split = append(split, name[lastPos:])
-	for _, s := range split {
-		if s == "" || s == "." || s == ".." {
-			return nil, errors.New("invalid level of directory: '" + s + "'")
-		}
+
+	// Check name
+	if err := checkName(name); err != nil {
+		return nil, err
 	}
 
 	// Check existence
@@ -138,11 +161,10 @@ func (w *Writer) CreateFile(name string, mode fs.FileMode, modTime time.Time) (i
 		return nil, fs.ErrExist
 	}
 
-	// Add file
+	// Add file. The offset is set when the file is first written.
 	f := &wfileDesc{
 		fileHeader: fileHeader{
 			name:    name,
-			offset:  w.getPos(),
 			mode:    mode,
 			modTime: modTime,
 		},
@@ -153,8 +175,33 @@ func (w *Writer) CreateFile(name string, mode fs.FileMode, modTime time.Time) (i
 	return f, nil
 }
 
+// Close writes the meta and closes the archive. Files still open are
+// closed implicitly.
 func (w *Writer) Close() error {
-	w.padTo32()
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.closed {
+		return fs.ErrClosed
+	}
+	w.closed = true
+
+	// Append spooled files
+	w.active = nil
+	for _, f := range w.spooled {
+		if err := w.commit(f); err != nil {
+			return err
+		}
+	}
+	w.spooled = nil
+
+	if err := w.padTo32(); err != nil {
+		return err
+	}
+	if w.indexed {
+		sort.SliceStable(w.file, func(i, j int) bool {
+			return dirCompare(w.file[i].name, w.file[j].name) < 0
+		})
+	}
 	metaStart := w.getPos()
 	buf := make([]byte, 32)
 
@@ -171,7 +218,12 @@ func (w *Writer) Close() error {
 	}
 
 	// Write file names
-	for _, h := range w.file {
+	namesStart := w.getPos()
+	nameOff := make([]int64, 0)
+	for i, h := range w.file {
+		if i%indexPageSize == 0 {
+			nameOff = append(nameOff, w.getPos()-namesStart)
+		}
 		buf := []byte(h.name)
 		buf = append(buf, 0)
 		if _, err := w.write(buf); err != nil {
@@ -179,8 +231,17 @@ func (w *Writer) Close() error {
 		}
 	}
 
+	// Write index
+	if w.indexed {
+		if err := w.writeIndex(nameOff, w.getPos()-namesStart); err != nil {
+			return err
+		}
+	}
+
 	// Write the final block
-	w.padTo32()
+	if err := w.padTo32(); err != nil {
+		return err
+	}
 	metaEnd := w.getPos() + 32
 	binary.LittleEndian.PutUint64(buf, uint64(metaEnd-metaStart))
 	binary.LittleEndian.PutUint64(buf[8:], uint64(len(w.file)))
@@ -191,6 +252,14 @@ func (w *Writer) Close() error {
 	if _, err := w.write(buf); err != nil {
 		return err
 	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	// Drop anything left by aborted files
+	if err := w.fd.Truncate(metaEnd); err != nil {
+		return err
+	}
 
 	// Update header
 	binary.LittleEndian.PutUint64(buf, uint64(metaEnd))
@@ -202,55 +271,274 @@ func (w *Writer) Close() error {
 }
 
 func (w *Writer) write(p []byte) (n int, err error) {
-	w.buf = append(w.buf, p...)
-	if len(w.buf) < 16 {
-		return len(p), nil
+	if w.err != nil {
+		return 0, w.err
 	}
+	for len(p) > 0 {
+		if len(w.buf) == cap(w.buf) {
+			if err = w.flush(); err != nil {
+				return n, err
+			}
+		}
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
 
-	end := len(w.buf) / 16 * 16
-	buf := w.buf[:end]
-	w.xorKeyStream(buf, buf, w.pos)
-
-	n, err = w.fd.Write(buf)
-	if err != nil {
-		return 0, err
+// flush encrypts and writes out buf.
+func (w *Writer) flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.buf) == 0 {
+		return nil
 	}
+	w.xorKeyStreamParallel(w.buf, w.buf, w.pos)
+	n, err := w.fd.Write(w.buf)
 	w.pos += int64(n)
-
-	buf = make([]byte, len(w.buf)-end)
-	copy(buf, w.buf[end:])
-	w.buf = buf
-	return len(p), nil
+	w.buf = w.buf[:0]
+	w.err = err
+	return err
 }
 
-func (w *Writer) padTo32() {
-	n := w.getPos() % 32
-	if n != 0 {
-		w.buf = append(w.buf, make([]byte, 32-n)...)
+func (w *Writer) padTo32() error {
+	if n := w.getPos() % 32; n != 0 {
+		_, err := w.write(make([]byte, 32-n))
+		return err
 	}
+	return nil
 }
 
 func (w *Writer) getPos() int64 {
 	return w.pos + int64(len(w.buf))
 }
 
+// readFrom reads r until EOF directly into buf.
+func (w *Writer) readFrom(r io.Reader) (n int64, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	for {
+		if len(w.buf) == cap(w.buf) {
+			if err = w.flush(); err != nil {
+				return n, err
+			}
+		}
+		m, rerr := r.Read(w.buf[len(w.buf):cap(w.buf)])
+		w.buf = w.buf[:len(w.buf)+m]
+		n += int64(m)
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// rewind moves the stream back to off, dropping what's written after it.
+func (w *Writer) rewind(off int64) error {
+	if off >= w.pos {
+		w.buf = w.buf[:off-w.pos]
+		return nil
+	}
+	if _, err := w.fd.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	w.pos = off
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// commitClosed appends spooled files that are already closed.
+// It must be called when no file is active.
+func (w *Writer) commitClosed() error {
+	spooled := w.spooled[:0]
+	for _, s := range w.spooled {
+		if !s.closed {
+			spooled = append(spooled, s)
+		} else if err := w.commit(s); err != nil {
+			return err
+		}
+	}
+	w.spooled = spooled
+	return nil
+}
+
+// commit appends the spooled content of f to the stream.
+func (w *Writer) commit(f *wfileDesc) error {
+	f.offset = w.getPos()
+	err := f.spool.writeTo(w)
+	if derr := f.spool.discard(); err == nil {
+		err = derr
+	}
+	f.spool = nil
+	return err
+}
+
 // wfileDesc represents an open file for write.
 type wfileDesc struct {
 	fileHeader
 	writer *Writer
 	closed bool
+
+	// spool is set if f is written while another file is active.
+	spool *spool
+
+	// werr is the first error of writing f to the archive or its spool,
+	// as opposed to reading the source in ReadFrom.
+	werr error
+}
+
+// failWrite records err as an error of writing f.
+func (f *wfileDesc) failWrite(err error) {
+	if err != nil && f.werr == nil {
+		f.werr = err
+	}
+}
+
+// acquire decides where the content of f goes before writing. It returns
+// true if f owns the stream.
+func (f *wfileDesc) acquire() (bool, error) {
+	w := f.writer
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if f.closed || w.closed {
+		return false, fs.ErrClosed
+	}
+	if w.active == f {
+		return true, nil
+	}
+	if w.active == nil && f.spool == nil {
+		w.active = f
+		f.offset = w.getPos()
+		return true, nil
+	}
+	if f.spool == nil {
+		f.spool = &spool{}
+		w.spooled = append(w.spooled, f)
+	}
+	return false, nil
 }
 
 func (f *wfileDesc) Write(p []byte) (n int, err error) {
-	if f.closed {
-		return 0, fs.ErrClosed
+	direct, err := f.acquire()
+	if err != nil {
+		return 0, err
+	}
+	if direct {
+		n, err = f.writer.write(p)
+	} else {
+		n, err = f.spool.Write(p)
 	}
-	n, err = f.writer.write(p)
 	f.size += int64(n)
+	f.failWrite(err)
+	return n, err
+}
+
+// ReadFrom implements io.ReaderFrom. It reads r until EOF into the file.
+//
+// For unencrypted archives, the data is copied by the os package, which
+// uses copy_file_range when r is a file. Otherwise, r is read directly
+// into the write buffer.
+func (f *wfileDesc) ReadFrom(r io.Reader) (n int64, err error) {
+	direct, err := f.acquire()
+	if err != nil {
+		f.failWrite(err)
+		return 0, err
+	}
+	w := f.writer
+
+	switch {
+	case !direct:
+		n, err = io.Copy(f.spool, r)
+		f.failWrite(f.spool.err)
+	case w.block == nil:
+		if err = w.flush(); err != nil {
+			f.failWrite(err)
+			return 0, err
+		}
+		// The os package reports errors of writing fd with its name
+		n, err = w.fd.ReadFrom(r)
+		w.pos += n
+		if isPathErr(err, w.fd.Name()) {
+			f.failWrite(err)
+		}
+	default:
+		n, err = w.readFrom(r)
+		f.failWrite(w.err)
+	}
+	f.size += n
 	return n, err
 }
 
+// isPathErr reports whether err is a *fs.PathError about the file at p.
+func isPathErr(err error, p string) bool {
+	var pe *fs.PathError
+	return errors.As(err, &pe) && pe.Path == p
+}
+
+// Close closes the file. If f is active, spooled files that are already
+// closed are appended.
 func (f *wfileDesc) Close() error {
+	w := f.writer
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if f.closed {
+		return fs.ErrClosed
+	}
 	f.closed = true
-	return nil
+	if w.closed {
+		return nil
+	}
+
+	if w.active == f {
+		w.active = nil
+	}
+	if w.active != nil {
+		return nil
+	}
+	return w.commitClosed()
+}
+
+func (f *wfileDesc) Abort() error {
+	w := f.writer
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if f.closed || w.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+
+	// Remove from index
+	i := w.fileIndex[f.name]
+	delete(w.fileIndex, f.name)
+	w.file = append(w.file[:i], w.file[i+1:]...)
+	for ; i < len(w.file); i++ {
+		w.fileIndex[w.file[i].name] = i
+	}
+
+	// Drop content
+	if f.spool != nil {
+		for i, s := range w.spooled {
+			if s == f {
+				w.spooled = append(w.spooled[:i], w.spooled[i+1:]...)
+				break
+			}
+		}
+		err := f.spool.discard()
+		f.spool = nil
+		return err
+	}
+	if w.active != f {
+		return nil
+	}
+	w.active = nil
+	if err := w.rewind(f.offset); err != nil {
+		return err
+	}
+	return w.commitClosed()
 }
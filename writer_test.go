@@ -0,0 +1,180 @@
+package quicktar
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// benchCiphers are the ciphers compared by benchmarks.
+var benchCiphers = []struct {
+	name   string
+	cipher func() Cipher
+}{
+	{"Store", func() Cipher { return Store }},
+	{"AES256", func() Cipher { return NewCipherNonce(EncAES256, []byte("password"), nil) }},
+}
+
+func BenchmarkWriter(b *testing.B) {
+	aes := benchCiphers[1].cipher
+	b.Run("Store", func(b *testing.B) { benchmarkWriter(b, Store) })
+	b.Run("AES256/Parallel", func(b *testing.B) { benchmarkWriter(b, aes()) })
+	b.Run("AES256/Serial", func(b *testing.B) {
+		defer func(n int) { parallelMinSize = n }(parallelMinSize)
+		parallelMinSize = math.MaxInt
+		benchmarkWriter(b, aes())
+	})
+}
+
+func benchmarkWriter(b *testing.B, cipher Cipher) {
+	w, err := NewWriter(filepath.Join(b.TempDir(), "bench.qtar"), cipher)
+	if err != nil {
+		b.Fatal(err)
+	}
+	f, err := w.Create("file")
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := make([]byte, writeBufSize)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		b.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func TestWriterFlushError(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.qtar")
+	w, err := NewWriter(name, Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := w.Create("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail the flush, then give a working fd back
+	fd := w.fd
+	w.fd, err = os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(make([]byte, writeBufSize+1)); err == nil {
+		t.Fatal("write to a read-only fd succeeded")
+	}
+	w.fd.Close()
+	w.fd = fd
+
+	// The flushed data is lost, so the Writer must stay failed
+	if _, err := f.Write(make([]byte, writeBufSize)); err == nil {
+		t.Error("write after a failed flush succeeded")
+	}
+	if err := w.Close(); err == nil {
+		t.Error("close after a failed flush succeeded")
+	}
+}
+
+func TestWriterConcurrent(t *testing.T) {
+	const n = 8
+	data := make([][]byte, n)
+	for i := range data {
+		data[i] = bytes.Repeat([]byte{byte('a' + i)}, (i+1)*writeBufSize/3)
+	}
+	const aborted = 5
+
+	for _, c := range benchCiphers {
+		name := filepath.Join(t.TempDir(), "test.qtar")
+		w, err := NewWriter(name, c.cipher())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		errs := make([]error, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = writeConcurrent(w, fmt.Sprint("f", i), data[i], i%2 == 0, i == aborted)
+			}(i)
+		}
+		wg.Wait()
+		for i, err := range errs {
+			if err != nil {
+				t.Fatalf("%s: f%d: %v", c.name, i, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := OpenReader(name, c.cipher())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errs := r.Validate(); errs != nil {
+			t.Errorf("%s: %v", c.name, errs)
+		}
+		if len(r.File) != n-1 {
+			t.Errorf("%s: %d files, want %d", c.name, len(r.File), n-1)
+		}
+		for _, f := range r.File {
+			var i int
+			fmt.Sscanf(f.Name, "f%d", &i)
+			if i == aborted {
+				t.Errorf("%s: aborted file is kept", c.name)
+				continue
+			}
+			got := make([]byte, f.Size())
+			if _, err := f.ReadAt(got, 0); err != nil || !bytes.Equal(got, data[i]) {
+				t.Errorf("%s: %s has wrong content: %v", c.name, f.Name, err)
+			}
+		}
+		r.Close()
+	}
+}
+
+// writeConcurrent writes data as name by small writes, or by ReadFrom if
+// readFrom is set. If abort is set, the file is aborted after half of the
+// data.
+func writeConcurrent(w *Writer, name string, data []byte, readFrom, abort bool) error {
+	f, err := w.Create(name)
+	if err != nil {
+		return err
+	}
+	if abort {
+		if _, err := f.Write(data[:len(data)/2]); err != nil {
+			return err
+		}
+		return f.Abort()
+	}
+	if readFrom {
+		_, err = f.(io.ReaderFrom).ReadFrom(bytes.NewReader(data))
+	} else {
+		for p := data; len(p) > 0 && err == nil; {
+			m := len(p)
+			if m > 4096 {
+				m = 4096
+			}
+			_, err = f.Write(p[:m])
+			p = p[m:]
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}